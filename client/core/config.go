@@ -2,24 +2,58 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"strings"
 
 	"github.com/PIngBZ/nctst"
 	"github.com/PIngBZ/nctst/proxyclient"
 )
 
 type Config struct {
-	UserName   string                 `json:"username"`
-	PassWord   string                 `json:"password"`
-	Listen     string                 `json:"listen"`
-	Server     *nctst.AddrInfo        `json:"server"`
-	Manager    *nctst.AddrInfo        `json:"manager"`
-	ProxyFile  *proxyclient.ProxyFile `json:"proxyfile"`
-	MapTargets []*nctst.AddrInfo      `json:"maptargets"`
-	Compress   bool                   `json:"compress"`
-	Key        string                 `json:"key"`
-	TunIP      string                 `json:"tunip"`
-	TunRoute   string                 `json:"tunroute"`
+	UserName   string `json:"username"`
+	PassWord   string `json:"password"`
+	Device     string `json:"device"`
+	Listen     string `json:"listen"`
+	HTTPListen string `json:"httplisten"`
+
+	// linux only, accepts connections redirected by iptables, mode redirect or tproxy
+	TransparentListen string `json:"transparentlisten"`
+	TransparentMode   string `json:"transparentmode"`
+
+	Server    *nctst.AddrInfo        `json:"server"`
+	Manager   *nctst.AddrInfo        `json:"manager"`
+	ProxyFile *proxyclient.ProxyFile `json:"proxyfile"`
+	// local ranking of the proxy list, default proxycache.json
+	ProxyCache string       `json:"proxycache"`
+	MapTargets []*MapTarget `json:"maptargets"`
+	// server ports forwarded back to the client side, allowed per user on the server
+	ReverseTargets []*ReverseTarget `json:"reversetargets"`
+	Compress       bool             `json:"compress"`
+	Key            string           `json:"key"`
+	TunIP          string           `json:"tunip"`
+	TunRoute       string           `json:"tunroute"`
+
+	// multiple servers mode, every profile runs its own tunnel and the local
+	// socks5 requests are routed by destination cidr or domain suffix
+	Name    string    `json:"name"`
+	Routes  []string  `json:"routes"`
+	Servers []*Config `json:"servers"`
+
+	// local socks5 rules, tunnel/direct/reject by destination
+	Rules       []*RuleConfig `json:"rules"`
+	RuleDefault string        `json:"ruledefault"`
+	// resolves the domain destinations locally for the cidr rules and routes,
+	// without it they only match the ip destinations
+	RuleResolve bool `json:"ruleresolve"`
+
+	// local dns server, resolves the configured domains through the tunnel
+	DNS *DNSConfig `json:"dns"`
+
+	// protects the local listeners
+	LocalUsers []*LocalUser `json:"localusers"`
+	AllowIPs   []string     `json:"allowips"`
 }
 
 func ParseConfig(configFile string) (*Config, error) {
@@ -35,5 +69,49 @@ func ParseConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.Device == "" {
+		cfg.Device, _ = os.Hostname()
+	}
+
+	if cfg.ProxyFile != nil {
+		if err := cfg.ProxyFile.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, server := range cfg.Servers {
+		if server.Name == "" {
+			server.Name = fmt.Sprintf("server%d", i)
+		}
+		if server.Device == "" {
+			server.Device = cfg.Device
+		}
+		// every server stack sends its commands with its own key
+		if server.Key == "" {
+			server.Key = cfg.Key
+		}
+		if server.Listen != "" || server.HTTPListen != "" || server.TransparentListen != "" || server.DNS != nil {
+			return nil, fmt.Errorf("server %s: listen is only allowed at top level", server.Name)
+		}
+		if len(server.Servers) > 0 {
+			return nil, fmt.Errorf("server %s: nested servers", server.Name)
+		}
+		if server.ProxyFile != nil {
+			if err := server.ProxyFile.Check(); err != nil {
+				return nil, fmt.Errorf("server %s: %+v", server.Name, err)
+			}
+		}
+		if len(server.Rules) > 0 || server.RuleDefault != "" || server.RuleResolve || len(server.LocalUsers) > 0 || len(server.AllowIPs) > 0 {
+			return nil, fmt.Errorf("server %s: rules and local auth are only allowed at top level", server.Name)
+		}
+		for _, route := range server.Routes {
+			if strings.Contains(route, "/") {
+				if _, _, err := net.ParseCIDR(route); err != nil {
+					return nil, fmt.Errorf("server %s: %+v", server.Name, err)
+				}
+			}
+		}
+	}
+
 	return cfg, nil
 }
@@ -1,12 +1,14 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/url"
+	"sync"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -15,155 +17,371 @@ import (
 )
 
 var (
-	UUID     = uuid.NewString()
-	ClientID uint
+	ErrClientStarted    = errors.New("client already started")
+	ErrClientNotRunning = errors.New("client not running")
+)
+
+type Client struct {
+	UUID    string
+	ID      uint
+	PingURL string
+	Status  *ClientStatus
 
-	authCode int
 	config   *Config
+	authCode int
+	connKey  string
+
+	listener         *net.TCPListener
+	httpProxy        *HTTPProxy
+	transparentProxy *TransparentProxy
+	dnsForwarder     *DNSForwarder
+	mapTargets       []*mapTargetEntry
+	mapTargetsLocker sync.Mutex
+	proxyListMgr     *ProxyListManager
+	rules            *Rules
+	auth             *LocalAuth
+	kcp              *nctst.Kcp
+	smuxClient       *smux.Session
+	duplicater       *nctst.Duplicater
+	proxyServers     []*ProxyServer
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+	kickoutOnce sync.Once
+	locker      sync.Mutex
+}
 
-	listener     *net.TCPListener
-	proxyListMgr = NewProxyListManager()
-	kcp          *nctst.Kcp
-	smuxClient   *smux.Session
-	duplicater   *nctst.Duplicater
+func NewClient(cfg *Config, code int) *Client {
+	h := &Client{}
+	h.UUID = uuid.NewString()
+	h.Status = NewClientStatus()
+	h.config = cfg
+	h.authCode = code
+	return h
+}
 
-	proxyServers = []*ProxyServer{}
+func (h *Client) Config() *Config {
+	return h.config
+}
 
-	connKey string
-)
+// closed when the running session has been stopped and all resources released
+func (h *Client) Done() <-chan struct{} {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if h.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return h.done
+}
+
+func (h *Client) AttachStatusObserver(observer chan *ClientStatus) {
+	h.Status.attachObserver(observer)
+}
+
+func (h *Client) DetachStatusObserver(observer chan *ClientStatus) {
+	h.Status.detachObserver(observer)
+}
 
-func Start(cfg *Config, code int) error {
-	Status.setStat(ClientStatusStep_Init)
+// connects through the proxies and starts the local socks5 service, the session
+// keeps running until Stop is called or ctx is canceled
+func (h *Client) Start(ctx context.Context) (err error) {
+	h.locker.Lock()
+	if h.cancel != nil {
+		h.locker.Unlock()
+		return ErrClientStarted
+	}
+	h.ctx, h.cancel = context.WithCancel(ctx)
+	h.done = make(chan struct{})
+	h.kickoutOnce = sync.Once{}
+	h.locker.Unlock()
+
+	started := make(chan struct{})
+	go h.daemon(started)
 
-	var success bool
 	defer func() {
-		if !success {
-			Stop()
+		close(started)
+		if err != nil {
+			h.Stop()
 		}
 	}()
 
-	config = cfg
-	authCode = code
+	h.Status.setReason("")
+	h.Status.setStat(ClientStatusStep_Init)
 
-	Status.setStat(ClientStatusStep_GetProxyList)
-	proxyListMgr = NewProxyListManager()
-	if err := proxyListMgr.Init(); err != nil {
+	h.Status.setStat(ClientStatusStep_GetProxyList)
+	h.proxyListMgr = NewProxyListManager(h)
+	if err := h.proxyListMgr.Init(); err != nil {
+		return err
+	}
+	if err := h.ctx.Err(); err != nil {
 		return err
 	}
 
-	Status.setStat(ClientStatusStep_Login)
-	err := WaittingLogin()
-	if err != nil {
+	h.Status.setStat(ClientStatusStep_Login)
+	if err := h.WaittingLogin(); err != nil {
 		return err
 	}
 
-	Status.setStat(ClientStatusStep_StartUpstream)
+	h.Status.setStat(ClientStatusStep_StartUpstream)
 
-	kcp = nctst.NewKcp(ClientID)
+	h.kcp = nctst.NewKcp(h.ID)
 
-	duplicater = nctst.NewDuplicater(kcp.OutputChan, func(v uint32) (uint32, []*nctst.OuterTunnel) {
-		tunnels := make([]*nctst.OuterTunnel, 0, len(proxyServers))
-		for _, proxyServer := range proxyServers {
+	h.duplicater = nctst.NewDuplicater(h.kcp.OutputChan, func(v uint32) (uint32, []*nctst.OuterTunnel) {
+		tunnels := make([]*nctst.OuterTunnel, 0, len(h.proxyServers))
+		for _, proxyServer := range h.proxyServers {
 			tunnels = append(tunnels, proxyServer.tunnel)
 		}
 		return 100, tunnels
 	})
 
-	startUpstreamProxies()
+	h.startUpstreamProxies()
 
-	if config.Compress {
-		smuxClient, err = smux.Client(nctst.NewCompStream(kcp), nctst.SmuxConfig())
+	var smuxClient *smux.Session
+	if h.config.Compress {
+		smuxClient, err = smux.Client(nctst.NewCompStream(h.kcp), nctst.SmuxConfig())
 	} else {
-		smuxClient, err = smux.Client(kcp, nctst.SmuxConfig())
+		smuxClient, err = smux.Client(h.kcp, nctst.SmuxConfig())
 	}
 	if err != nil {
 		return err
 	}
 
-	Status.setStat(ClientStatusStep_StartMapLocal)
-	startMapTargetsLoop(smuxClient, config.MapTargets)
+	h.locker.Lock()
+	h.smuxClient = smuxClient
+	h.locker.Unlock()
 
-	time.Sleep(time.Second * 3)
+	h.Status.setStat(ClientStatusStep_StartMapLocal)
+	h.startMapTargetsLoop(h.config.MapTargets)
+	h.startReverseTargets(smuxClient, h.config.ReverseTargets)
 
-	Status.setStat(ClientStatusStep_StartLocalService)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Listen)
-	if err != nil {
+	if err := h.sleep(time.Second * 3); err != nil {
 		return err
 	}
 
-	listener, err = net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return err
-	}
+	// without listen the client is driven by a Router
+	if h.config.Listen != "" {
+		h.Status.setStat(ClientStatusStep_StartLocalService)
+		tcpAddr, err := net.ResolveTCPAddr("tcp", h.config.Listen)
+		if err != nil {
+			return err
+		}
 
-	go func() {
-		for {
-			conn, err := listener.AcceptTCP()
-			if err != nil {
-				log.Printf("main AcceptTCP exit: %+v\n", err)
-				return
+		h.listener, err = net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return err
+		}
+
+		if len(h.config.Rules) > 0 || h.config.RuleDefault != "" {
+			var resolver *ruleResolver
+			if h.config.RuleResolve {
+				resolver = newRuleResolver()
+			}
+			if h.rules, err = NewRules(h.config.Rules, h.config.RuleDefault, resolver); err != nil {
+				return err
 			}
+		}
+		if h.auth, err = NewLocalAuth(h.config.LocalUsers, h.config.AllowIPs); err != nil {
+			return err
+		}
 
-			log.Printf("main AcceptTCP %s\n", conn.RemoteAddr().String())
+		go func(listener *net.TCPListener, smuxClient *smux.Session, rules *Rules, auth *LocalAuth) {
+			for {
+				conn, err := listener.AcceptTCP()
+				if err != nil {
+					log.Printf("main AcceptTCP exit: %+v\n", err)
+					return
+				}
+
+				log.Printf("main AcceptTCP %s\n", conn.RemoteAddr().String())
+
+				// with rules or auth the request has to be parsed locally
+				if rules != nil || auth != nil {
+					go serveLocalSocks5(conn, auth, rules, func(string, string) *Client { return h })
+				} else {
+					go doTransfer(conn, smuxClient)
+				}
+			}
+		}(h.listener, smuxClient, h.rules, h.auth)
+	}
 
-			go doTransfer(conn, smuxClient)
+	if h.config.HTTPListen != "" {
+		listener, err := net.Listen("tcp", h.config.HTTPListen)
+		if err != nil {
+			return err
 		}
-	}()
 
-	Status.setStat(ClientStatusStep_CheckingConnection)
+		rules := h.rules
+		h.httpProxy = NewHTTPProxy(h.auth, func(host string, port int) (net.Conn, error) {
+			return dialByRules(rules, func(string, string) *Client { return h }, host, port)
+		})
+		go h.httpProxy.Serve(listener)
+		log.Printf("http proxy listening: %s\n", h.config.HTTPListen)
+	}
+
+	if h.config.TransparentListen != "" {
+		rules := h.rules
+		h.transparentProxy, err = NewTransparentProxy(h.config.TransparentListen, h.config.TransparentMode, h.auth, func(host string, port int) (net.Conn, error) {
+			return dialByRules(rules, func(string, string) *Client { return h }, host, port)
+		})
+		if err != nil {
+			return err
+		}
+		go h.transparentProxy.Serve()
+		log.Printf("transparent proxy listening: %s\n", h.config.TransparentListen)
+	}
+
+	if h.config.DNS != nil && h.config.DNS.Listen != "" {
+		h.dnsForwarder, err = NewDNSForwarder(h.config.DNS, func(string) (net.Conn, error) {
+			return h.OpenStream()
+		})
+		if err != nil {
+			return err
+		}
+		go h.dnsForwarder.Serve()
+		log.Printf("dns listening: %s\n", h.config.DNS.Listen)
+	}
+
+	h.Status.setStat(ClientStatusStep_CheckingConnection)
 
-	CheckConnection() // ignore first request
-	time.Sleep(time.Second)
+	h.CheckConnection() // ignore first request
+	if err := h.sleep(time.Second); err != nil {
+		return err
+	}
 
-	err, delay := CheckConnection()
+	err, delay := h.CheckConnection()
 	if err != nil {
 		return fmt.Errorf("CheckConnection %+v", err)
 	}
 
-	Status.setPing(delay)
-	Status.setStat(ClientStatusStep_Running)
-	success = true
-	log.Printf("Start finished, socks5 listening: %s\n\n", config.Listen)
+	h.Status.setPing(delay)
+	h.Status.setStat(ClientStatusStep_Running)
+	log.Printf("Start finished %s, socks5 listening: %s\n\n", h.config.Name, h.config.Listen)
 	return nil
 }
 
-func Stop() {
-	for _, proxyServer := range proxyServers {
+// stops the running session and waits until all resources are released
+func (h *Client) Stop() {
+	h.locker.Lock()
+	cancel, done := h.cancel, h.done
+	h.locker.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+func (h *Client) daemon(started chan struct{}) {
+	<-started
+	<-h.ctx.Done()
+
+	h.release()
+
+	h.locker.Lock()
+	h.cancel = nil
+	close(h.done)
+	h.locker.Unlock()
+}
+
+func (h *Client) release() {
+	for _, proxyServer := range h.proxyServers {
 		if proxyServer != nil {
 			proxyServer.SendLogout()
 		}
 	}
 
-	if listener == nil {
-		listener.Close()
-		listener = nil
+	if h.listener != nil {
+		h.listener.Close()
+		h.listener = nil
+	}
+
+	if h.httpProxy != nil {
+		h.httpProxy.Close()
+		h.httpProxy = nil
+	}
+
+	if h.transparentProxy != nil {
+		h.transparentProxy.Close()
+		h.transparentProxy = nil
+	}
+
+	if h.dnsForwarder != nil {
+		h.dnsForwarder.Close()
+		h.dnsForwarder = nil
 	}
 
-	closeAllMapTargets()
+	h.rules = nil
+	h.auth = nil
 
-	if duplicater != nil {
-		duplicater.Close()
-		duplicater = nil
+	if h.duplicater != nil {
+		h.duplicater.Close()
+		h.duplicater = nil
 	}
 
-	stopUpstreamProxies()
+	h.stopUpstreamProxies()
+
+	h.locker.Lock()
+	smuxClient := h.smuxClient
+	h.smuxClient = nil
+	h.locker.Unlock()
 
 	if smuxClient != nil {
 		smuxClient.Close()
-		smuxClient = nil
 	}
 
-	if kcp != nil {
-		kcp.Close()
-		kcp = nil
+	h.closeAllMapTargets()
+
+	if h.kcp != nil {
+		h.kcp.Close()
+		h.kcp = nil
 	}
 
-	if proxyListMgr != nil {
-		proxyListMgr.Release()
-		proxyListMgr = nil
+	if h.proxyListMgr != nil {
+		h.proxyListMgr.Release()
+		h.proxyListMgr = nil
+	}
+}
+
+func (h *Client) sleep(d time.Duration) error {
+	select {
+	case <-h.ctx.Done():
+		return h.ctx.Err()
+	case <-time.After(d):
+		return nil
 	}
 }
 
+func (h *Client) onKickout(cmd *nctst.CommandKickout) {
+	if cmd.ClientUUID != h.UUID {
+		return
+	}
+
+	h.kickoutOnce.Do(func() {
+		log.Printf("kicked out by server: %s\n", cmd.Reason)
+		h.Status.setReason(cmd.Reason)
+		h.Status.setStat(ClientStatusStep_Failed)
+		h.Stop()
+	})
+}
+
+// opens a raw stream to the server side socks5 service
+func (h *Client) OpenStream() (net.Conn, error) {
+	h.locker.Lock()
+	smuxClient := h.smuxClient
+	h.locker.Unlock()
+
+	if smuxClient == nil {
+		return nil, ErrClientNotRunning
+	}
+	return smuxClient.OpenStream()
+}
+
 func doTransfer(conn *net.TCPConn, smuxClient *smux.Session) {
 	stream, err := smuxClient.OpenStream()
 	if err != nil {
@@ -179,50 +397,46 @@ func doTransfer(conn *net.TCPConn, smuxClient *smux.Session) {
 	go nctst.Transfer(conn, stream)
 }
 
-func startUpstreamProxies() {
-	proxyServers = make([]*ProxyServer, proxyListMgr.SelectNum)
-	for i := 0; i < proxyListMgr.SelectNum; i++ {
-		proxyServers[i] = NewProxyServer(uint(i))
+func (h *Client) startUpstreamProxies() {
+	proxyServers := make([]*ProxyServer, 0, h.proxyListMgr.SelectNum)
+	for i := 0; i < h.proxyListMgr.SelectNum; i++ {
+		if proxyServer := NewProxyServer(h, uint(i)); proxyServer != nil {
+			proxyServers = append(proxyServers, proxyServer)
+		}
 	}
+	h.proxyServers = proxyServers
 }
 
-func stopUpstreamProxies() {
-	if proxyServers == nil {
+func (h *Client) stopUpstreamProxies() {
+	if h.proxyServers == nil {
 		return
 	}
 
-	for _, proxyServer := range proxyServers {
+	for _, proxyServer := range h.proxyServers {
 		if proxyServer != nil {
 			proxyServer.Close()
 		}
 	}
-	proxyServers = nil
+	h.proxyServers = nil
 }
 
-func CheckConnection() (error, int) {
-	var proxy string
-	if config.Listen[0] == ':' {
-		proxy = "socks5://127.0.0.1" + config.Listen
-	} else {
-		proxy = "socks5://" + config.Listen
-	}
-
+func (h *Client) CheckConnection() (error, int) {
 	httpClient := &http.Client{
 		Transport: &http.Transport{
-			Proxy: func(_ *http.Request) (*url.URL, error) {
-				return url.Parse(proxy)
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialSocks5(h.OpenStream, addr)
 			},
 		},
 		Timeout: time.Second * 5,
 	}
 
 	start := time.Now().UnixNano()
-	req, err := http.NewRequest("GET", PingURL+fmt.Sprintf("?t=%d", start), nil)
+	req, err := http.NewRequestWithContext(h.ctx, "GET", h.PingURL+fmt.Sprintf("?t=%d", start), nil)
 	if err != nil {
 		return err, 0
 	}
 
-	req.SetBasicAuth(config.UserName, config.PassWord)
+	req.SetBasicAuth(h.config.UserName, h.config.PassWord)
 
 	response, err := httpClient.Do(req)
 	if err != nil {
@@ -0,0 +1,328 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheSize   = 4096
+	dnsMaxTTL      = time.Hour
+	dnsNegativeTTL = time.Second * 30
+	dnsSystemTTL   = 60
+	dnsTimeout     = time.Second * 5
+)
+
+type DNSConfig struct {
+	Listen string `json:"listen"`
+	// domain suffixes resolved by the server side resolver, empty means all
+	Domains []string `json:"domains"`
+	// resolver for the other domains, empty uses the system resolver
+	Upstream string `json:"upstream"`
+}
+
+type dnsCacheItem struct {
+	data   []byte
+	expire time.Time
+}
+
+// local udp dns server, the configured domains are sent as dns-over-tcp through
+// a tunnel stream, the others go to the upstream or the system resolver
+type DNSForwarder struct {
+	config  *DNSConfig
+	domains []string
+	open    func(name string) (net.Conn, error)
+	conn    *net.UDPConn
+
+	cache       map[string]*dnsCacheItem
+	cacheLocker sync.Mutex
+}
+
+func NewDNSForwarder(cfg *DNSConfig, open func(name string) (net.Conn, error)) (*DNSForwarder, error) {
+	addr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &DNSForwarder{}
+	h.config = cfg
+	h.open = open
+	h.cache = make(map[string]*dnsCacheItem)
+	for _, domain := range cfg.Domains {
+		if domain = strings.ToLower(strings.Trim(domain, ".")); domain != "" {
+			h.domains = append(h.domains, domain)
+		}
+	}
+
+	if h.conn, err = net.ListenUDP("udp", addr); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *DNSForwarder) Serve() {
+	buf := make([]byte, nctst.UDP_PACKET_SIZE)
+	for {
+		n, peer, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("DNSForwarder ReadFromUDP exit: %+v\n", err)
+			return
+		}
+
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go h.handle(peer, query)
+	}
+}
+
+func (h *DNSForwarder) Close() {
+	h.conn.Close()
+}
+
+func (h *DNSForwarder) handle(peer *net.UDPAddr, query []byte) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return
+	}
+
+	key := question.Name.String() + question.Type.String() + question.Class.String()
+	if response := h.cacheGet(key); response != nil {
+		copy(response, query[:2])
+		h.conn.WriteToUDP(response, peer)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+
+	var response []byte
+	if h.viaTunnel(name) {
+		response, err = h.exchangeTunnel(name, query)
+	} else if h.config.Upstream != "" {
+		response, err = exchangeUDP(h.config.Upstream, query)
+	} else {
+		response, err = resolveSystem(header, question)
+	}
+
+	if err != nil {
+		log.Printf("DNSForwarder %s: %+v\n", name, err)
+		if response, err = dnsReply(header, question, dnsmessage.RCodeServerFailure, nil); err != nil {
+			return
+		}
+	} else {
+		h.cachePut(key, response)
+	}
+
+	h.conn.WriteToUDP(response, peer)
+}
+
+func (h *DNSForwarder) viaTunnel(name string) bool {
+	if len(h.domains) == 0 {
+		return true
+	}
+	for _, domain := range h.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// one stream for every query, opening smux streams costs no round trip
+func (h *DNSForwarder) exchangeTunnel(name string, query []byte) ([]byte, error) {
+	stream, err := h.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(dnsTimeout))
+
+	data := make([]byte, 6+len(query))
+	binary.BigEndian.PutUint32(data, nctst.DNS_RELAY_KEY)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(query)))
+	copy(data[6:], query)
+	if _, err = stream.Write(data); err != nil {
+		return nil, err
+	}
+
+	l := make([]byte, 2)
+	if _, err = io.ReadFull(stream, l); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err = io.ReadFull(stream, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func exchangeUDP(upstream string, query []byte) ([]byte, error) {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+
+	conn, err := net.DialTimeout("udp", upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, nctst.UDP_PACKET_SIZE)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// the system resolver only answers addresses
+func resolveSystem(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	var network string
+	switch question.Type {
+	case dnsmessage.TypeA:
+		network = "ip4"
+	case dnsmessage.TypeAAAA:
+		network = "ip6"
+	default:
+		return dnsReply(header, question, dnsmessage.RCodeNotImplemented, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, strings.TrimSuffix(question.Name.String(), "."))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return dnsReply(header, question, dnsmessage.RCodeNameError, nil)
+		}
+		return nil, err
+	}
+
+	return dnsReply(header, question, dnsmessage.RCodeSuccess, ips)
+}
+
+func dnsReply(header dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) ([]byte, error) {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsSystemTTL}
+	for _, ip := range ips {
+		var err error
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			body := dnsmessage.AResource{}
+			copy(body.A[:], ip4)
+			err = builder.AResource(resource, body)
+		} else if question.Type == dnsmessage.TypeAAAA {
+			body := dnsmessage.AAAAResource{}
+			copy(body.AAAA[:], ip.To16())
+			err = builder.AAAAResource(resource, body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Finish()
+}
+
+func (h *DNSForwarder) cacheGet(key string) []byte {
+	h.cacheLocker.Lock()
+	defer h.cacheLocker.Unlock()
+
+	item, ok := h.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(item.expire) {
+		delete(h.cache, key)
+		return nil
+	}
+
+	data := make([]byte, len(item.data))
+	copy(data, item.data)
+	return data
+}
+
+// caches successful and name error answers by the smallest ttl
+func (h *DNSForwarder) cachePut(key string, response []byte) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil || (header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	if err = parser.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return
+	}
+
+	ttl := dnsMaxTTL
+	if len(answers) == 0 {
+		ttl = dnsNegativeTTL
+	}
+	for _, answer := range answers {
+		if d := time.Duration(answer.Header.TTL) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	data := make([]byte, len(response))
+	copy(data, response)
+
+	h.cacheLocker.Lock()
+	defer h.cacheLocker.Unlock()
+
+	if len(h.cache) >= dnsCacheSize {
+		now := time.Now()
+		for k, item := range h.cache {
+			if now.After(item.expire) {
+				delete(h.cache, k)
+			}
+		}
+		if len(h.cache) >= dnsCacheSize {
+			h.cache = make(map[string]*dnsCacheItem)
+		}
+	}
+	h.cache[key] = &dnsCacheItem{data: data, expire: time.Now().Add(ttl)}
+}
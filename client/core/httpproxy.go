@@ -0,0 +1,200 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// local http proxy, CONNECT and plain http requests are sent through the same
+// streams as the socks5 listener
+type HTTPProxy struct {
+	auth      *LocalAuth
+	dial      func(host string, port int) (net.Conn, error)
+	server    *http.Server
+	transport *http.Transport
+}
+
+func NewHTTPProxy(auth *LocalAuth, dial func(host string, port int) (net.Conn, error)) *HTTPProxy {
+	h := &HTTPProxy{}
+	h.auth = auth
+	h.dial = dial
+	h.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := splitHostPort(addr, 80)
+			if err != nil {
+				return nil, err
+			}
+			return h.dial(host, port)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+	}
+	h.server = &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	return h
+}
+
+func (h *HTTPProxy) Serve(listener net.Listener) {
+	if err := h.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Printf("HTTPProxy Serve exit: %+v\n", err)
+	}
+}
+
+func (h *HTTPProxy) Close() {
+	h.server.Close()
+	h.transport.CloseIdleConnections()
+}
+
+func (h *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.checkAuth(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		h.handleConnect(w, r)
+		return
+	}
+
+	if r.URL.Scheme != "http" || r.URL.Host == "" {
+		http.Error(w, "only http and CONNECT proxy requests are supported", http.StatusBadRequest)
+		return
+	}
+
+	r.RequestURI = ""
+	for _, header := range hopHeaders {
+		r.Header.Del(header)
+	}
+
+	response, err := h.transport.RoundTrip(r)
+	if err != nil {
+		log.Printf("HTTPProxy RoundTrip %s: %+v\n", r.URL.Host, err)
+		http.Error(w, err.Error(), statusFromError(err))
+		return
+	}
+	defer response.Body.Close()
+
+	for _, header := range hopHeaders {
+		response.Header.Del(header)
+	}
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+func (h *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := splitHostPort(r.Host, 443)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	remote, err := h.dial(host, port)
+	if err != nil {
+		log.Printf("HTTPProxy CONNECT %s: %+v\n", r.Host, err)
+		http.Error(w, err.Error(), statusFromError(err))
+		return
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		remote.Close()
+		log.Printf("HTTPProxy Hijack: %+v\n", err)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+
+	// bytes the client sent right after the CONNECT header
+	if n := bufrw.Reader.Buffered(); n > 0 {
+		data, _ := bufrw.Reader.Peek(n)
+		if _, err = remote.Write(data); err != nil {
+			conn.Close()
+			remote.Close()
+			return
+		}
+	}
+
+	log.Printf("HTTPProxy CONNECT %s -> %s\n", conn.RemoteAddr().String(), r.Host)
+	go nctst.Transfer(conn, remote)
+}
+
+func (h *HTTPProxy) checkAuth(w http.ResponseWriter, r *http.Request) bool {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err != nil || !h.auth.AllowAddr(addr) {
+		log.Printf("HTTPProxy source not allowed %s\n", r.RemoteAddr)
+		http.Error(w, "source not allowed", http.StatusForbidden)
+		return false
+	}
+
+	if !h.auth.NeedPassword() {
+		return true
+	}
+
+	// http.Request.BasicAuth only reads Authorization
+	r2 := &http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	if userName, passWord, ok := r2.BasicAuth(); ok && h.auth.Check(userName, passWord) {
+		return true
+	}
+
+	w.Header().Set("Proxy-Authenticate", `Basic realm="nctst"`)
+	http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+	return false
+}
+
+func splitHostPort(addr string, defaultPort int) (string, int, error) {
+	if !strings.Contains(addr, ":") || strings.HasSuffix(addr, "]") {
+		return strings.Trim(addr, "[]"), defaultPort, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func statusFromError(err error) int {
+	if errors.Is(err, ErrRuleRejected) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
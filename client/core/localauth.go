@@ -0,0 +1,134 @@
+package core
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+var (
+	ErrLocalAuth = errors.New("local auth failed")
+)
+
+type LocalUser struct {
+	UserName string `json:"username"`
+	PassWord string `json:"password"`
+}
+
+// protects the local socks5 and http listeners, nil means no restriction
+type LocalAuth struct {
+	users  map[string]string
+	ipNets []*net.IPNet
+}
+
+func NewLocalAuth(users []*LocalUser, allowIPs []string) (*LocalAuth, error) {
+	if len(users) == 0 && len(allowIPs) == 0 {
+		return nil, nil
+	}
+
+	h := &LocalAuth{}
+	h.users = make(map[string]string)
+	for _, user := range users {
+		if user.UserName == "" {
+			return nil, errors.New("local user name is empty")
+		}
+		h.users[user.UserName] = user.PassWord
+	}
+
+	for _, item := range allowIPs {
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			if ip := net.ParseIP(item); ip != nil {
+				ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+			} else {
+				return nil, fmt.Errorf("error allowips %s", item)
+			}
+		}
+		h.ipNets = append(h.ipNets, ipNet)
+	}
+	return h, nil
+}
+
+func (h *LocalAuth) NeedPassword() bool {
+	return h != nil && len(h.users) > 0
+}
+
+func (h *LocalAuth) AllowAddr(addr net.Addr) bool {
+	if h == nil || len(h.ipNets) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range h.ipNets {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *LocalAuth) Check(userName, passWord string) bool {
+	if !h.NeedPassword() {
+		return true
+	}
+
+	pwd, ok := h.users[userName]
+	return ok && subtle.ConstantTimeCompare([]byte(pwd), []byte(passWord)) == 1
+}
+
+// socks5 method selection with RFC 1929 username/password when required
+func (h *LocalAuth) socks5Negotiate(conn net.Conn, methods []byte) error {
+	if !h.NeedPassword() {
+		_, err := conn.Write([]byte{5, 0})
+		return err
+	}
+
+	var offered bool
+	for _, method := range methods {
+		if method == 2 {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return ErrLocalAuth
+	}
+
+	if _, err := conn.Write([]byte{5, 2}); err != nil {
+		return err
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != 1 {
+		return errors.New("socks5 auth version error")
+	}
+	userName := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, userName); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, head[:1]); err != nil {
+		return err
+	}
+	passWord := make([]byte, head[0])
+	if _, err := io.ReadFull(conn, passWord); err != nil {
+		return err
+	}
+
+	if !h.Check(string(userName), string(passWord)) {
+		conn.Write([]byte{1, 1})
+		return ErrLocalAuth
+	}
+
+	_, err := conn.Write([]byte{1, 0})
+	return err
+}
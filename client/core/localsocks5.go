@@ -0,0 +1,190 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+var (
+	ErrRuleRejected = errors.New("rejected by rules")
+)
+
+const (
+	socks5RepSuccess         = 0
+	socks5RepNotAllowed      = 2
+	socks5RepHostUnreachable = 4
+	socks5RepCmdNotSupported = 7
+)
+
+// answers the socks5 greeting locally and reads the request to decide by rules,
+// tunneled requests replay a greeting and the request on the server stream
+func serveLocalSocks5(conn *net.TCPConn, auth *LocalAuth, rules *Rules, pick func(server, host string) *Client) {
+	if !auth.AllowAddr(conn.RemoteAddr()) {
+		conn.Close()
+		log.Printf("serveLocalSocks5 source not allowed %s\n", conn.RemoteAddr().String())
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	request, host, port, err := readSocks5Request(conn, auth)
+	if err != nil {
+		conn.Close()
+		log.Printf("serveLocalSocks5 readSocks5Request: %+v\n", err)
+		return
+	}
+
+	action, server := rules.Match(host, port)
+	switch action {
+	case RuleAction_Reject:
+		log.Printf("serveLocalSocks5 reject %s:%d\n", host, port)
+		writeSocks5Reply(conn, socks5RepNotAllowed)
+		conn.Close()
+	case RuleAction_Direct:
+		directTransfer(conn, request[1], host, port)
+	default:
+		tunnelTransfer(conn, request, pick(server, host), host)
+	}
+}
+
+func tunnelTransfer(conn *net.TCPConn, request []byte, client *Client, host string) {
+	stream, err := client.OpenStream()
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepHostUnreachable)
+		conn.Close()
+		log.Printf("tunnelTransfer OpenStream %s: %+v\n", client.config.Name, err)
+		return
+	}
+
+	stream.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err = stream.Write(append([]byte{5, 1, 0}, request...)); err != nil {
+		conn.Close()
+		stream.Close()
+		log.Printf("tunnelTransfer write request: %+v\n", err)
+		return
+	}
+
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(stream, reply); err != nil || reply[0] != 5 || reply[1] != 0 {
+		conn.Close()
+		stream.Close()
+		log.Printf("tunnelTransfer read method reply: %v %+v\n", reply, err)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+	stream.SetDeadline(time.Time{})
+
+	log.Printf("tunnelTransfer %s -> %s %s\n", conn.RemoteAddr().String(), client.config.Name, host)
+	go nctst.Transfer(conn, stream)
+}
+
+func directTransfer(conn *net.TCPConn, cmd byte, host string, port int) {
+	if cmd != 1 {
+		writeSocks5Reply(conn, socks5RepCmdNotSupported)
+		conn.Close()
+		return
+	}
+
+	remote, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), time.Second*5)
+	if err != nil {
+		writeSocks5Reply(conn, socks5RepHostUnreachable)
+		conn.Close()
+		log.Printf("directTransfer Dial %s:%d: %+v\n", host, port, err)
+		return
+	}
+
+	if err = writeSocks5Reply(conn, socks5RepSuccess); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("directTransfer %s -> %s:%d\n", conn.RemoteAddr().String(), host, port)
+	go nctst.Transfer(conn, remote)
+}
+
+// used by the local services which only need a connected stream
+func dialByRules(rules *Rules, pick func(server, host string) *Client, host string, port int) (net.Conn, error) {
+	target := net.JoinHostPort(host, strconv.Itoa(port))
+
+	action, server := rules.Match(host, port)
+	switch action {
+	case RuleAction_Reject:
+		return nil, ErrRuleRejected
+	case RuleAction_Direct:
+		return net.DialTimeout("tcp", target, time.Second*5)
+	default:
+		return dialSocks5(pick(server, host).OpenStream, target)
+	}
+}
+
+// VER REP RSV ATYP BND.ADDR BND.PORT, bind address is not used by clients
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{5, rep, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// returns the raw request, the destination host and port
+func readSocks5Request(conn net.Conn, auth *LocalAuth) ([]byte, string, int, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, "", 0, err
+	}
+	if head[0] != 5 {
+		return nil, "", 0, errors.New("socks5 version error")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, "", 0, err
+	}
+	if err := auth.socks5Negotiate(conn, methods); err != nil {
+		return nil, "", 0, err
+	}
+
+	// VER CMD RSV ATYP
+	request := make([]byte, 4, 4+1+255+2)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, "", 0, err
+	}
+
+	var addrLen int
+	switch request[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return nil, "", 0, err
+		}
+		request = append(request, n[0])
+		addrLen = int(n[0])
+	case 4:
+		addrLen = net.IPv6len
+	default:
+		return nil, "", 0, errors.New("socks5 address type error")
+	}
+
+	start := len(request)
+	request = request[:start+addrLen+2]
+	if _, err := io.ReadFull(conn, request[start:]); err != nil {
+		return nil, "", 0, err
+	}
+
+	addr := request[start : start+addrLen]
+	port := int(binary.BigEndian.Uint16(request[start+addrLen:]))
+	if request[3] == 3 {
+		return request, string(addr), port, nil
+	}
+	return request, net.IP(addr).String(), port, nil
+}
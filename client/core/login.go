@@ -13,21 +13,19 @@ import (
 var (
 	ErrLoginAuthority = errors.New("error username or password")
 	ErrLoginAuthCode  = errors.New("error auth code")
-
-	PingURL string
 )
 
-func WaittingLogin() error {
-	log.Println("login ...", len(proxyListMgr.All))
+func (h *Client) WaittingLogin() error {
+	log.Println("login ...", len(h.proxyListMgr.All))
 
-	for _, p := range proxyListMgr.All {
-		client := proxyclient.NewProxyClient(p, config.Server)
+	for _, p := range h.proxyListMgr.All {
+		client := proxyclient.NewProxyClient(p, h.config.Server)
 		if client == nil {
 			continue
 		}
 
-		if err := tryLogin(client); err == nil {
-			log.Printf("login success %d\n", ClientID)
+		if err := h.tryLogin(client); err == nil {
+			log.Printf("login success %d\n", h.ID)
 			return nil
 		} else if err == ErrLoginAuthority || err == ErrLoginAuthCode {
 			log.Printf("try login failed %s\n", p.Host)
@@ -37,13 +35,15 @@ func WaittingLogin() error {
 		}
 
 		log.Println("wait 5s to try login through another proxy ...")
-		time.Sleep(time.Second * 3)
+		if err := h.sleep(time.Second * 3); err != nil {
+			return err
+		}
 	}
 	log.Println("all proxies login failed")
 	return errors.New("all proxies login failed")
 }
 
-func tryLogin(client proxyclient.ProxyClient) error {
+func (h *Client) tryLogin(client proxyclient.ProxyClient) error {
 	err := client.Connect()
 	if err != nil {
 		return err
@@ -53,34 +53,35 @@ func tryLogin(client proxyclient.ProxyClient) error {
 
 	client.SetDeadline(time.Now().Add(time.Second * 5))
 
-	if err = sendLoginCommand(client); err != nil {
+	if err = h.sendLoginCommand(client); err != nil {
 		return err
 	}
 
-	if err = receiveLoginReply(client); err != nil {
+	if err = h.receiveLoginReply(client); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func sendLoginCommand(conn io.Writer) error {
+func (h *Client) sendLoginCommand(conn io.Writer) error {
 	if err := nctst.WriteUInt(conn, nctst.NEW_CONNECTION_KEY); err != nil {
 		return err
 	}
 
 	cmd := &nctst.CommandLogin{}
-	cmd.AuthCode = authCode
-	cmd.UserName = config.UserName
-	cmd.PassWord = nctst.HashPassword(config.UserName, config.PassWord)
-	cmd.ClientUUID = UUID
-	cmd.Compress = config.Compress
-	cmd.Key = config.Key
+	cmd.AuthCode = h.authCode
+	cmd.UserName = h.config.UserName
+	cmd.PassWord = nctst.HashPassword(h.config.UserName, h.config.PassWord)
+	cmd.Device = h.config.Device
+	cmd.ClientUUID = h.UUID
+	cmd.Compress = h.config.Compress
+	cmd.Key = h.config.Key
 	log.Printf("**Do login code: %d, name: %s", cmd.AuthCode, cmd.UserName)
-	return nctst.SendCommand(conn, &nctst.Command{Type: nctst.Cmd_login, Item: cmd})
+	return nctst.SendCommandWithKey(conn, &nctst.Command{Type: nctst.Cmd_login, Item: cmd}, h.config.Key)
 }
 
-func receiveLoginReply(conn io.Reader) error {
+func (h *Client) receiveLoginReply(conn io.Reader) error {
 	buf, err := nctst.ReadLBuf(conn)
 	if err != nil {
 		return err
@@ -91,7 +92,7 @@ func receiveLoginReply(conn io.Reader) error {
 		return errors.New("receiveLoginReply type error")
 	}
 
-	command, err := nctst.ReadCommand(buf)
+	command, err := nctst.ReadCommandWithKey(buf, h.config.Key)
 	buf.Release()
 	if err != nil {
 		return err
@@ -104,9 +105,9 @@ func receiveLoginReply(conn io.Reader) error {
 		return ErrLoginAuthority
 	}
 
-	ClientID = cmd.ClientID
-	connKey = cmd.ConnectKey
-	PingURL = cmd.PingURL
+	h.ID = cmd.ClientID
+	h.connKey = cmd.ConnectKey
+	h.PingURL = cmd.PingURL
 
 	return nil
 }
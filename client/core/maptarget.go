@@ -1,66 +1,225 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/PIngBZ/nctst"
 	"github.com/PIngBZ/socks5"
-	"github.com/xtaci/smux"
 )
 
 var (
-	mapTargetListeners []*net.TCPListener
+	ErrMapTargetExists   = errors.New("map target already exists")
+	ErrMapTargetNotFound = errors.New("map target not found")
 )
 
-func startMapTargetsLoop(smuxClient *smux.Session, targets []*nctst.AddrInfo) {
+type MapTarget struct {
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// tcp (default) or udp
+	Proto string `json:"proto"`
+	// local bind address and port, a random port is used when localport is 0 or in use
+	LocalHost string `json:"localhost"`
+	LocalPort int    `json:"localport"`
+}
+
+func (h *MapTarget) Address() string {
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+}
+
+// the actual mapping of a running map target
+type MapTargetInfo struct {
+	Name   string `json:"name"`
+	Proto  string `json:"proto"`
+	Target string `json:"target"`
+	Local  string `json:"local"`
+}
+
+type mapTargetEntry struct {
+	info     *MapTargetInfo
+	listener io.Closer
+}
+
+func (h *Client) startMapTargetsLoop(targets []*MapTarget) {
 	if len(targets) == 0 {
 		return
 	}
 
-	port := 2000 + rand.Intn(3000)
 	log.Printf("\n\n++++++++++Preparing map local port to remote address++++++++++\n\n")
 	defer log.Print("\n\n----------map local port end----------\n\n")
 
-	mapTargetListeners = make([]*net.TCPListener, 0, len(targets))
 	for _, target := range targets {
-		for {
-			addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%d", port))
+		if _, err := h.addMapTarget(target, false); err != nil {
+			log.Printf("startMapTargetsLoop %s: %+v\n", target.Address(), err)
+		}
+	}
+}
+
+// starts a map target on the running client
+func (h *Client) AddMapTarget(target *MapTarget) (*MapTargetInfo, error) {
+	return h.addMapTarget(target, true)
+}
+
+func (h *Client) RemoveMapTarget(name string) error {
+	h.mapTargetsLocker.Lock()
+	defer h.mapTargetsLocker.Unlock()
+
+	for i, entry := range h.mapTargets {
+		if entry.info.Name == name {
+			h.mapTargets = append(h.mapTargets[:i:i], h.mapTargets[i+1:]...)
+			entry.listener.Close()
+			log.Printf("**Local [%s] <-----x-----> remote %s removed\n", entry.info.Local, entry.info.Target)
+			h.Status.setMapTargets(h.mapTargetInfos())
+			return nil
+		}
+	}
+	return ErrMapTargetNotFound
+}
+
+func (h *Client) MapTargets() []*MapTargetInfo {
+	h.mapTargetsLocker.Lock()
+	defer h.mapTargetsLocker.Unlock()
+	return h.mapTargetInfos()
+}
+
+func (h *Client) mapTargetInfos() []*MapTargetInfo {
+	list := make([]*MapTargetInfo, 0, len(h.mapTargets))
+	for _, entry := range h.mapTargets {
+		info := *entry.info
+		list = append(list, &info)
+	}
+	return list
+}
+
+func (h *Client) addMapTarget(target *MapTarget, checkRunning bool) (*MapTargetInfo, error) {
+	if target.Host == "" || target.Port <= 0 {
+		return nil, fmt.Errorf("error map target %s", target.Address())
+	}
+
+	proto := target.Proto
+	if proto == "" {
+		proto = "tcp"
+	} else if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("error map target proto %s", proto)
+	}
+
+	name := target.Name
+	if name == "" {
+		name = proto + "://" + target.Address()
+	}
+
+	h.mapTargetsLocker.Lock()
+	defer h.mapTargetsLocker.Unlock()
+
+	// release closes the map targets after the session, so a target added
+	// while the session is alive is always closed
+	if checkRunning {
+		h.locker.Lock()
+		running := h.smuxClient != nil
+		h.locker.Unlock()
+
+		if !running {
+			return nil, ErrClientNotRunning
+		}
+	}
+
+	for _, entry := range h.mapTargets {
+		if entry.info.Name == name {
+			return nil, ErrMapTargetExists
+		}
+	}
+
+	listener, local, err := listenMapTarget(target, proto)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &mapTargetEntry{}
+	entry.info = &MapTargetInfo{Name: name, Proto: proto, Target: target.Address(), Local: local}
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		entry.listener = l
+		go mapTargetLoop(h, target, l)
+	case *net.UDPConn:
+		entry.listener = newUDPMapTarget(h, target.Address(), l)
+	}
+	h.mapTargets = append(h.mapTargets, entry)
+
+	log.Printf("**Local %s [%s] <----------> remote %s\n", proto, entry.info.Local, entry.info.Target)
+
+	h.Status.setMapTargets(h.mapTargetInfos())
+
+	info := *entry.info
+	return &info, nil
+}
+
+// returns a *net.TCPListener or *net.UDPConn and its local address
+func listenMapTarget(target *MapTarget, proto string) (io.Closer, string, error) {
+	listen := func(port int) (io.Closer, string, error) {
+		address := net.JoinHostPort(target.LocalHost, strconv.Itoa(port))
+		if proto == "udp" {
+			addr, err := net.ResolveUDPAddr("udp", address)
 			if err != nil {
-				log.Printf("startMapTargetsLoop ResolveTCPAddr %+v\n", err)
-				continue
+				return nil, "", err
 			}
-
-			listener, err := net.ListenTCP("tcp", addr)
+			conn, err := net.ListenUDP("udp", addr)
 			if err != nil {
-				port++
-				continue
+				return nil, "", err
 			}
+			return conn, conn.LocalAddr().String(), nil
+		}
 
-			log.Printf("**Local [:%d] <----------> remote %s\n", port, target.Address())
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			return nil, "", err
+		}
+		listener, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			return nil, "", err
+		}
+		return listener, listener.Addr().String(), nil
+	}
+
+	if target.LocalPort > 0 {
+		listener, local, err := listen(target.LocalPort)
+		if err == nil {
+			return listener, local, nil
+		}
+		log.Printf("listenMapTarget %s %d fallback to random port: %+v\n", proto, target.LocalPort, err)
+	}
 
-			mapTargetListeners = append(mapTargetListeners, listener)
-			go mapTargetLoop(smuxClient, target, listener)
-			break
+	port := 2000 + rand.Intn(3000)
+	for i := 0; i < 1000; i++ {
+		if listener, local, err := listen(port + i); err == nil {
+			return listener, local, nil
 		}
 	}
+	return nil, "", errors.New("no free local port")
 }
 
-func closeAllMapTargets() {
-	if mapTargetListeners == nil {
+func (h *Client) closeAllMapTargets() {
+	h.mapTargetsLocker.Lock()
+	defer h.mapTargetsLocker.Unlock()
+
+	if h.mapTargets == nil {
 		return
 	}
 
-	for _, listener := range mapTargetListeners {
-		listener.Close()
+	for _, entry := range h.mapTargets {
+		entry.listener.Close()
 	}
-	mapTargetListeners = nil
+	h.mapTargets = nil
+	h.Status.setMapTargets(nil)
 }
 
-func mapTargetLoop(smuxClient *smux.Session, target *nctst.AddrInfo, listener *net.TCPListener) {
+func mapTargetLoop(client *Client, target *MapTarget, listener *net.TCPListener) {
 	for {
 		conn, err := listener.AcceptTCP()
 		if err != nil {
@@ -70,29 +229,32 @@ func mapTargetLoop(smuxClient *smux.Session, target *nctst.AddrInfo, listener *n
 
 		log.Printf("mapTargetLoop AcceptTCP %s\n", conn.RemoteAddr().String())
 
-		go mapTargetDoTransfer(conn, smuxClient, target)
+		go mapTargetDoTransfer(conn, client, target)
 	}
 }
 
-func mapTargetDoTransfer(conn *net.TCPConn, smuxClient *smux.Session, target *nctst.AddrInfo) {
+func mapTargetDoTransfer(conn *net.TCPConn, client *Client, target *MapTarget) {
+	upConn, err := dialSocks5(client.OpenStream, target.Address())
+	if err != nil {
+		conn.Close()
+		log.Printf("mapTargetDoTransfer Connect: %+v\n", err)
+		return
+	}
 
+	log.Printf("mapTargetDoTransfer Transfer %s\n", conn.RemoteAddr().String())
+	go nctst.Transfer(conn, upConn)
+}
+
+func dialSocks5(openStream func() (net.Conn, error), target string) (net.Conn, error) {
 	client := socks5.Client{
 		HandshakeTimeout: time.Second * 5,
 		Auth: map[socks5.METHOD]socks5.Authenticator{
 			socks5.NO_AUTHENTICATION_REQUIRED: socks5.NoAuth{},
 		},
 		Dialer: func(client *socks5.Client, request *socks5.Request) (net.Conn, error) {
-			return smuxClient.OpenStream()
+			return openStream()
 		},
 	}
 
-	upConn, err := client.Connect(socks5.Version5, target.Address())
-	if err != nil {
-		conn.Close()
-		log.Printf("mapTargetDoTransfer Connect: %+v\n", err)
-		return
-	}
-
-	log.Printf("mapTargetDoTransfer Transfer %s\n", conn.RemoteAddr().String())
-	go nctst.Transfer(conn, upConn)
+	return client.Connect(socks5.Version5, target)
 }
@@ -19,6 +19,7 @@ type ProxyConnector struct {
 	ID      uint
 	ProxyID uint
 
+	client       *Client
 	clientGetter func(*ProxyConnector) proxyclient.ProxyClient
 	tunnel       *nctst.OuterTunnel
 
@@ -26,10 +27,11 @@ type ProxyConnector struct {
 	dieOnce sync.Once
 }
 
-func NewProxyConnector(id uint, proxyID uint, tunnel *nctst.OuterTunnel, clientGetter func(*ProxyConnector) proxyclient.ProxyClient) *ProxyConnector {
+func NewProxyConnector(client *Client, id uint, proxyID uint, tunnel *nctst.OuterTunnel, clientGetter func(*ProxyConnector) proxyclient.ProxyClient) *ProxyConnector {
 	h := &ProxyConnector{}
 	h.ID = id
 	h.ProxyID = proxyID
+	h.client = client
 	h.clientGetter = clientGetter
 
 	h.tunnel = tunnel
@@ -137,12 +139,12 @@ func (h *ProxyConnector) sendHandshake(conn io.Writer) error {
 	}
 
 	cmd := &nctst.CommandHandshake{}
-	cmd.ClientUUID = UUID
-	cmd.ClientID = ClientID
+	cmd.ClientUUID = h.client.UUID
+	cmd.ClientID = h.client.ID
 	cmd.TunnelID = h.tunnel.ID
 	cmd.ConnID = h.ID
-	cmd.ConnectKey = connKey
-	return nctst.SendCommand(conn, &nctst.Command{Type: nctst.Cmd_handshake, Item: cmd})
+	cmd.ConnectKey = h.client.connKey
+	return nctst.SendCommandWithKey(conn, &nctst.Command{Type: nctst.Cmd_handshake, Item: cmd}, h.client.config.Key)
 }
 
 func (h *ProxyConnector) receiveHandshakeReply(conn io.Reader) error {
@@ -156,7 +158,7 @@ func (h *ProxyConnector) receiveHandshakeReply(conn io.Reader) error {
 		return errors.New("receiveHandshakeReply type error")
 	}
 
-	command, err := nctst.ReadCommand(buf)
+	command, err := nctst.ReadCommandWithKey(buf, h.client.config.Key)
 	buf.Release()
 
 	if err != nil {
@@ -19,14 +19,17 @@ type ProxyListManager struct {
 	SelectNum int
 	version   string
 
+	client *Client
+
 	Locker sync.Mutex
 
 	die     chan struct{}
 	dieOnce sync.Once
 }
 
-func NewProxyListManager() *ProxyListManager {
+func NewProxyListManager(client *Client) *ProxyListManager {
 	h := &ProxyListManager{}
+	h.client = client
 
 	h.AllIdx = mapset.NewSet[string]()
 	h.UsingIdx = mapset.NewSet[string]()
@@ -40,28 +43,37 @@ func (h *ProxyListManager) Init() error {
 		return err
 	}
 
-	if config.ProxyFile.Type == "net" {
-		go h.daemon()
-	}
+	go h.daemon()
 
 	return nil
 }
 
 func (h *ProxyListManager) requestProxyList() (error, bool) {
+	config := h.client.config
 	if config.ProxyFile == nil || len(config.ProxyFile.Url) == 0 {
 		return errors.New("no proxy config"), false
 	}
 
-	SelectNum, All, version := proxyclient.GetProxyList(config.ProxyFile, &proxyclient.PingTarget{Target: config.Server, PingThreads: 5}, config.Key, config.UserName, config.PassWord)
-
-	if len(All) == 0 {
+	proxyGroups := proxyclient.GetProxyGroups(config.ProxyFile, config.Key, config.UserName, config.PassWord)
+	if proxyGroups == nil {
 		return errors.New("GetProxyList return empty"), false
 	}
 
-	if len(h.version) != 0 && version == h.version {
+	if len(h.version) != 0 && proxyGroups.Version == h.version {
 		return errors.New("no new version proxy list"), false
 	}
 
+	SelectNum, version := proxyGroups.ClientTotalSelect, proxyGroups.Version
+	All, cached := h.restoreCache(proxyGroups)
+	if !cached {
+		All = proxyclient.SelectProxyFromGroupsInfo(proxyGroups, h.pingTarget())
+		go h.reportProbes(version, probeResults(proxyGroups))
+	}
+
+	if len(All) == 0 {
+		return errors.New("GetProxyList return empty"), false
+	}
+
 	log.Printf("**Found %d items from server %s\n", len(All), config.ProxyFile.Url)
 
 	if len(All) == 0 || SelectNum == 0 {
@@ -73,6 +85,10 @@ func (h *ProxyListManager) requestProxyList() (error, bool) {
 
 	h.All = All
 	h.SelectNum = nctst.Min(len(All), SelectNum)
+	h.version = version
+	if !cached {
+		h.saveCache()
+	}
 
 	h.AllIdx.Clear()
 	for _, v := range h.All {
@@ -115,28 +131,35 @@ func (h *ProxyListManager) Put(proxy *proxyclient.ProxyInfo) {
 
 	if h.AllIdx.Contains(proxy.Address()) && proxy.PingTime.Add(time.Hour).Before(time.Now()) {
 		go func() {
-			client := proxyclient.NewProxyClient(proxy, config.Server)
-			client.Ping(client, false, nil)
+			result := h.probe(proxy)
 
 			h.Locker.Lock()
 			defer h.Locker.Unlock()
 
+			result.Apply(proxy)
 			sort.SliceStable(h.All, func(i, j int) bool {
-				return h.All[i].Ping < h.All[j].Ping
+				return h.All[i].Score < h.All[j].Score
 			})
+			h.saveCache()
 		}()
 	}
 }
 
 func (h *ProxyListManager) daemon() {
 	ticker := time.NewTicker(time.Hour * 6)
+	rerankTicker := time.NewTicker(time.Hour)
 	for {
 		select {
 		case <-h.die:
 			return
+		case <-rerankTicker.C:
+			h.rerank()
 		case <-ticker.C:
+			if h.client.config.ProxyFile.Type != "net" {
+				continue
+			}
 			if err, updated := h.requestProxyList(); err == nil && updated {
-				for _, proxyServer := range proxyServers {
+				for _, proxyServer := range h.client.proxyServers {
 					if proxyServer != nil {
 						if !h.AllIdx.Contains(proxyServer.proxy.Address()) {
 							proxyServer.ChangeProxy()
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/PIngBZ/nctst/proxyclient"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	proxyCacheTTL = time.Hour * 6
+)
+
+// the local ranking of a proxy list version, so a restart does not probe again
+type proxyCache struct {
+	Version  string                                   `json:"ver"`
+	Time     time.Time                                `json:"time"`
+	Selected []string                                 `json:"selected"`
+	Results  map[string]*proxyclient.ProxyProbeResult `json:"results"`
+}
+
+func (h *ProxyListManager) pingTarget() *proxyclient.PingTarget {
+	return &proxyclient.PingTarget{Target: h.client.config.Server, Key: h.client.config.Key, PingThreads: 5}
+}
+
+func (h *ProxyListManager) cacheFile() string {
+	if h.client.config.ProxyCache != "" {
+		return h.client.config.ProxyCache
+	}
+	if h.client.config.Name != "" {
+		return fmt.Sprintf("proxycache_%s.json", h.client.config.Name)
+	}
+	return "proxycache.json"
+}
+
+// the cached ranking when it is for this version and fresh
+func (h *ProxyListManager) restoreCache(proxyGroups *proxyclient.ProxyGroups) ([]*proxyclient.ProxyInfo, bool) {
+	data, err := os.ReadFile(h.cacheFile())
+	if err != nil {
+		return nil, false
+	}
+
+	var cache *proxyCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		log.Printf("restoreCache %+v\n", err)
+		return nil, false
+	}
+
+	if cache.Version != proxyGroups.Version || cache.Time.Add(proxyCacheTTL).Before(time.Now()) {
+		return nil, false
+	}
+
+	nodes := make(map[string]*proxyclient.ProxyInfo)
+	for _, group := range proxyGroups.Groups {
+		for _, proxy := range group.List {
+			nodes[proxy.NodeID()] = proxy
+		}
+	}
+
+	result := make([]*proxyclient.ProxyInfo, 0, len(cache.Selected))
+	for _, node := range cache.Selected {
+		proxy, ok := nodes[node]
+		if !ok {
+			continue
+		}
+		if r, ok := cache.Results[node]; ok {
+			r.Apply(proxy)
+		}
+		result = append(result, proxy)
+	}
+
+	if len(result) == 0 {
+		return nil, false
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Score < result[j].Score
+	})
+
+	log.Printf("**Restored %d items from %s, version %s\n", len(result), h.cacheFile(), cache.Version)
+	return result, true
+}
+
+// called with the locker held
+func (h *ProxyListManager) saveCache() {
+	cache := &proxyCache{
+		Version:  h.version,
+		Time:     time.Now(),
+		Selected: make([]string, 0, len(h.All)),
+		Results:  make(map[string]*proxyclient.ProxyProbeResult),
+	}
+	for _, proxy := range h.All {
+		cache.Selected = append(cache.Selected, proxy.NodeID())
+		cache.Results[proxy.NodeID()] = proxyclient.NewProxyProbeResult(proxy)
+	}
+
+	data, err := json.MarshalIndent(cache, "", "    ")
+	if err != nil {
+		log.Printf("saveCache %+v\n", err)
+		return
+	}
+	if err := os.WriteFile(h.cacheFile(), data, 0600); err != nil {
+		log.Printf("saveCache %+v\n", err)
+	}
+}
+
+// probes copies of the selected proxies again, from where this client runs,
+// the results are applied with the locker held
+func (h *ProxyListManager) rerank() {
+	h.Locker.Lock()
+	all := append([]*proxyclient.ProxyInfo(nil), h.All...)
+	version := h.version
+	h.Locker.Unlock()
+
+	if len(all) == 0 {
+		return
+	}
+
+	results := make([]*proxyclient.ProxyProbeResult, 0, len(all))
+	for _, proxy := range all {
+		results = append(results, h.probe(proxy))
+	}
+
+	h.Locker.Lock()
+	for i, proxy := range all {
+		results[i].Apply(proxy)
+	}
+	sort.SliceStable(h.All, func(i, j int) bool {
+		return h.All[i].Score < h.All[j].Score
+	})
+	h.saveCache()
+	h.Locker.Unlock()
+
+	h.reportProbes(version, results)
+}
+
+// Probe writes the measurements, the proxy itself is shared with Get and saveCache
+func (h *ProxyListManager) probe(proxy *proxyclient.ProxyInfo) *proxyclient.ProxyProbeResult {
+	h.Locker.Lock()
+	probed := *proxy
+	h.Locker.Unlock()
+
+	proxyclient.Probe(&probed, h.pingTarget(), false)
+	return proxyclient.NewProxyProbeResult(&probed)
+}
+
+// the measurements are sent to the server next to the proxy list url,
+// sealed like the proxy list with the key and the password hash
+func (h *ProxyListManager) reportProbes(version string, results []*proxyclient.ProxyProbeResult) {
+	config := h.client.config
+	if config.ProxyFile == nil || config.ProxyFile.Type != "net" {
+		return
+	}
+
+	report := &proxyclient.ProxyProbeReport{Version: version}
+	for _, result := range results {
+		if !result.Time.IsZero() {
+			report.Results = append(report.Results, result)
+		}
+	}
+	if len(report.Results) == 0 {
+		return
+	}
+
+	base, err := url.Parse(config.ProxyFile.Url)
+	if err != nil {
+		log.Printf("reportProbes %+v\n", err)
+		return
+	}
+	reportUrl := base.ResolveReference(&url.URL{Path: "proxyprobe"}).String()
+
+	buf, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("reportProbes %+v\n", err)
+		return
+	}
+
+	if buf, err = proxyclient.SealProxyList(buf, proxyclient.ProxyListSecret(config.Key, nctst.HashPassword(config.UserName, config.PassWord))); err != nil {
+		log.Printf("reportProbes %+v\n", err)
+		return
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	nctst.WriteLData(buffer, buf)
+	req, err := retryablehttp.NewRequest("POST", reportUrl, buffer)
+	if err != nil {
+		log.Printf("reportProbes %+v\n", err)
+		return
+	}
+	req.SetBasicAuth(config.UserName, config.PassWord)
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = time.Second * 15
+	client.RetryMax = 3
+
+	response, err := client.Do(req)
+	if err != nil {
+		log.Printf("reportProbes %s %+v\n", reportUrl, err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		log.Printf("reportProbes %s statuscode %d\n", reportUrl, response.StatusCode)
+		return
+	}
+
+	log.Printf("reportProbes %d results to %s\n", len(report.Results), reportUrl)
+}
+
+// taken before the proxies are shared
+func probeResults(proxyGroups *proxyclient.ProxyGroups) []*proxyclient.ProxyProbeResult {
+	results := make([]*proxyclient.ProxyProbeResult, 0)
+	for _, group := range proxyGroups.Groups {
+		for _, proxy := range group.List {
+			results = append(results, proxyclient.NewProxyProbeResult(proxy))
+		}
+	}
+	return results
+}
@@ -10,32 +10,40 @@ import (
 
 type ProxyServer struct {
 	ID         uint
+	client     *Client
 	tunnel     *nctst.OuterTunnel
 	connectors []*ProxyConnector
 
 	proxy *proxyclient.ProxyInfo
 
+	commandChan chan *nctst.Command
+
 	die     chan struct{}
 	dieOnce sync.Once
 }
 
-func NewProxyServer(id uint) *ProxyServer {
+func NewProxyServer(client *Client, id uint) *ProxyServer {
 	h := &ProxyServer{}
 	h.ID = id
+	h.client = client
 	h.die = make(chan struct{})
 
-	h.proxy = proxyListMgr.Get()
+	h.proxy = client.proxyListMgr.Get()
 	if h.proxy == nil {
 		log.Println("NewProxyServer no enougth proxy server")
 		return nil
 	}
 
-	h.tunnel = nctst.NewOuterTunnel(config.Key, h.ID, ClientID, kcp.InputChan, duplicater.Output, nil)
+	h.tunnel = nctst.NewOuterTunnel(client.config.Key, h.ID, client.ID, client.kcp.InputChan, client.duplicater.Output, nil)
+
+	h.commandChan = make(chan *nctst.Command, 8)
+	h.tunnel.CommandManager.AttachCommandObserver(h.commandChan)
+	go h.daemon()
 
 	h.connectors = make([]*ProxyConnector, h.proxy.ConnNum)
 	for i := 0; i < h.proxy.ConnNum; i++ {
-		h.connectors[uint(i)] = NewProxyConnector(uint(i), h.ID, h.tunnel, func(pc *ProxyConnector) proxyclient.ProxyClient {
-			return proxyclient.NewProxyClient(h.proxy, config.Server)
+		h.connectors[uint(i)] = NewProxyConnector(client, uint(i), h.ID, h.tunnel, func(pc *ProxyConnector) proxyclient.ProxyClient {
+			return proxyclient.NewProxyClient(h.proxy, client.config.Server)
 		})
 	}
 
@@ -44,6 +52,7 @@ func NewProxyServer(id uint) *ProxyServer {
 }
 
 func (h *ProxyServer) ChangeProxy() {
+	proxyListMgr := h.client.proxyListMgr
 	newProxy := proxyListMgr.Get()
 	if newProxy == nil {
 		log.Println("ChangeProxy no enougth proxy server")
@@ -66,8 +75,8 @@ func (h *ProxyServer) SendLogout() {
 	}
 
 	cmd := &nctst.CommandLogout{}
-	cmd.UserName = config.UserName
-	cmd.ClientUUID = UUID
+	cmd.UserName = h.client.config.UserName
+	cmd.ClientUUID = h.client.UUID
 	h.tunnel.SendCommand(&nctst.Command{Type: nctst.Cmd_logout, Item: cmd})
 }
 
@@ -87,10 +96,25 @@ func (h *ProxyServer) Close() {
 	}
 	h.connectors = nil
 
+	h.tunnel.CommandManager.DetachCommandObserver(h.commandChan)
 	h.tunnel.Close()
 	h.tunnel = nil
 }
 
+func (h *ProxyServer) daemon() {
+	for {
+		select {
+		case <-h.die:
+			return
+		case command := <-h.commandChan:
+			if command.Type == nctst.Cmd_kickout {
+				go h.client.onKickout(command.Item.(*nctst.CommandKickout))
+				return
+			}
+		}
+	}
+}
+
 func (c *ProxyServer) IsClosed() bool {
 	select {
 	case <-c.die:
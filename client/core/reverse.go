@@ -0,0 +1,122 @@
+package core
+
+import (
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/xtaci/smux"
+)
+
+// the server listens on remoteport and the accepted connections are carried
+// back to host:port on the client side
+type ReverseTarget struct {
+	Name       string `json:"name"`
+	RemotePort int    `json:"remoteport"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+}
+
+func (h *ReverseTarget) Address() string {
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
+}
+
+func (h *Client) startReverseTargets(smuxClient *smux.Session, targets []*ReverseTarget) {
+	if len(targets) == 0 {
+		return
+	}
+
+	byPort := make(map[int]*ReverseTarget)
+	for _, target := range targets {
+		if target.RemotePort <= 0 || target.RemotePort > 65535 || target.Host == "" || target.Port <= 0 {
+			log.Printf("startReverseTargets error target %d -> %s\n", target.RemotePort, target.Address())
+			continue
+		}
+		if _, ok := byPort[target.RemotePort]; ok {
+			log.Printf("startReverseTargets duplicate remote port %d\n", target.RemotePort)
+			continue
+		}
+		byPort[target.RemotePort] = target
+	}
+
+	// the server opens the streams only for registered ports
+	go reverseAcceptLoop(smuxClient, byPort)
+
+	for _, target := range byPort {
+		if err := registerReverse(smuxClient, target); err != nil {
+			log.Printf("startReverseTargets register %d: %+v\n", target.RemotePort, err)
+			continue
+		}
+		log.Printf("**Remote [:%d] <----------> local %s\n", target.RemotePort, target.Address())
+	}
+}
+
+// the registration lasts while the stream is open
+func registerReverse(smuxClient *smux.Session, target *ReverseTarget) error {
+	stream, err := smuxClient.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	if err = nctst.WriteReverseRegister(stream, target.RemotePort); err != nil {
+		stream.Close()
+		return err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(time.Second * 10))
+	if err = nctst.ReadReverseResult(stream); err != nil {
+		stream.Close()
+		return err
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	go func() {
+		io.Copy(io.Discard, stream)
+		stream.Close()
+		log.Printf("**Remote [:%d] <-----x-----> local %s closed\n", target.RemotePort, target.Address())
+	}()
+	return nil
+}
+
+func reverseAcceptLoop(smuxClient *smux.Session, targets map[int]*ReverseTarget) {
+	for {
+		stream, err := smuxClient.AcceptStream()
+		if err != nil {
+			log.Printf("reverseAcceptLoop AcceptStream exit: %+v\n", err)
+			return
+		}
+
+		go reverseDoTransfer(stream, targets)
+	}
+}
+
+func reverseDoTransfer(stream *smux.Stream, targets map[int]*ReverseTarget) {
+	stream.SetReadDeadline(time.Now().Add(time.Second * 10))
+	port, remote, err := nctst.ReadReverseHeader(stream)
+	if err != nil {
+		stream.Close()
+		log.Printf("reverseDoTransfer ReadReverseHeader: %+v\n", err)
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	target, ok := targets[port]
+	if !ok {
+		stream.Close()
+		log.Printf("reverseDoTransfer unknown remote port %d\n", port)
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", target.Address(), time.Second*5)
+	if err != nil {
+		stream.Close()
+		log.Printf("reverseDoTransfer Dial %s: %+v\n", target.Address(), err)
+		return
+	}
+
+	log.Printf("reverseDoTransfer %s -> %s\n", remote, target.Address())
+	nctst.Transfer(stream, conn)
+}
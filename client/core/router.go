@@ -0,0 +1,301 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/PIngBZ/nctst"
+)
+
+type routeRule struct {
+	ipNet  *net.IPNet
+	suffix string
+	client *Client
+}
+
+// host is empty for ip destinations, ip is nil for domains not resolved
+func (h *routeRule) match(host string, ip net.IP) bool {
+	if h.ipNet != nil {
+		return ip != nil && h.ipNet.Contains(ip)
+	}
+	return host != "" && (host == h.suffix || strings.HasSuffix(host, "."+h.suffix))
+}
+
+// runs one Client for every server profile and dispatches the local socks5
+// requests to them by destination
+type Router struct {
+	Clients []*Client
+
+	config      *Config
+	routes      []*routeRule
+	rules       *Rules
+	resolver    *ruleResolver
+	auth        *LocalAuth
+	fallback    *Client
+	listener    *net.TCPListener
+	http        *HTTPProxy
+	transparent *TransparentProxy
+	dns         *DNSForwarder
+
+	cancel context.CancelFunc
+	locker sync.Mutex
+}
+
+// codes are the auth codes in the order of cfg.Servers, a single code is used for all
+func NewRouter(cfg *Config, codes []int) (*Router, error) {
+	if len(cfg.Servers) == 0 {
+		return nil, errors.New("no servers config")
+	}
+	if len(codes) != 1 && len(codes) != len(cfg.Servers) {
+		return nil, fmt.Errorf("need 1 or %d auth codes", len(cfg.Servers))
+	}
+
+	h := &Router{}
+	h.config = cfg
+
+	for i, server := range cfg.Servers {
+		client := NewClient(server, codes[nctst.Min(i, len(codes)-1)])
+		h.Clients = append(h.Clients, client)
+
+		if len(server.Routes) == 0 && h.fallback == nil {
+			h.fallback = client
+		}
+
+		for _, route := range server.Routes {
+			rule := &routeRule{client: client}
+			if strings.Contains(route, "/") {
+				_, ipNet, err := net.ParseCIDR(route)
+				if err != nil {
+					return nil, err
+				}
+				rule.ipNet = ipNet
+			} else {
+				rule.suffix = strings.ToLower(strings.Trim(route, "."))
+			}
+			h.routes = append(h.routes, rule)
+		}
+	}
+
+	if h.fallback == nil {
+		h.fallback = h.Clients[0]
+	}
+
+	for _, rule := range cfg.Rules {
+		if rule.Server != "" && h.client(rule.Server) == nil {
+			return nil, fmt.Errorf("rule server %s not found", rule.Server)
+		}
+	}
+
+	if cfg.RuleResolve {
+		h.resolver = newRuleResolver()
+	}
+
+	var err error
+	if h.rules, err = NewRules(cfg.Rules, cfg.RuleDefault, h.resolver); err != nil {
+		return nil, err
+	}
+	if h.auth, err = NewLocalAuth(cfg.LocalUsers, cfg.AllowIPs); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Router) client(name string) *Client {
+	for _, client := range h.Clients {
+		if client.config.Name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+func (h *Router) Route(host string) *Client {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if ip != nil {
+		host = ""
+	}
+
+	resolved := ip != nil || h.resolver == nil
+	for _, rule := range h.routes {
+		if !resolved && rule.ipNet != nil {
+			ip, resolved = h.resolver.Lookup(host), true
+		}
+		if rule.match(host, ip) {
+			return rule.client
+		}
+	}
+	return h.fallback
+}
+
+// starts all clients, fails if any of them can not start
+func (h *Router) Start(ctx context.Context) error {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if h.cancel != nil {
+		return ErrClientStarted
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	errs := make([]error, len(h.Clients))
+	var wg sync.WaitGroup
+	for i, client := range h.Clients {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			if errs[i] = client.Start(ctx); errs[i] != nil {
+				cancel()
+			}
+		}(i, client)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			h.stopClients()
+			cancel()
+			return fmt.Errorf("%s: %+v", h.Clients[i].config.Name, err)
+		}
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", h.config.Listen)
+	if err != nil {
+		h.stopClients()
+		cancel()
+		return err
+	}
+
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		h.stopClients()
+		cancel()
+		return err
+	}
+
+	if h.config.HTTPListen != "" {
+		httpListener, err := net.Listen("tcp", h.config.HTTPListen)
+		if err != nil {
+			listener.Close()
+			h.stopClients()
+			cancel()
+			return err
+		}
+
+		h.http = NewHTTPProxy(h.auth, func(host string, port int) (net.Conn, error) {
+			return dialByRules(h.rules, h.pick, host, port)
+		})
+		go h.http.Serve(httpListener)
+	}
+
+	if h.config.TransparentListen != "" {
+		h.transparent, err = NewTransparentProxy(h.config.TransparentListen, h.config.TransparentMode, h.auth, func(host string, port int) (net.Conn, error) {
+			return dialByRules(h.rules, h.pick, host, port)
+		})
+		if err != nil {
+			if h.http != nil {
+				h.http.Close()
+				h.http = nil
+			}
+			listener.Close()
+			h.stopClients()
+			cancel()
+			return err
+		}
+		go h.transparent.Serve()
+	}
+
+	if h.config.DNS != nil && h.config.DNS.Listen != "" {
+		h.dns, err = NewDNSForwarder(h.config.DNS, func(name string) (net.Conn, error) {
+			return h.Route(name).OpenStream()
+		})
+		if err != nil {
+			if h.transparent != nil {
+				h.transparent.Close()
+				h.transparent = nil
+			}
+			if h.http != nil {
+				h.http.Close()
+				h.http = nil
+			}
+			listener.Close()
+			h.stopClients()
+			cancel()
+			return err
+		}
+		go h.dns.Serve()
+	}
+
+	h.listener = listener
+	h.cancel = cancel
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				log.Printf("Router AcceptTCP exit: %+v\n", err)
+				return
+			}
+
+			go h.doTransfer(conn)
+		}
+	}()
+
+	log.Printf("Router started %d servers, socks5 listening: %s\n\n", len(h.Clients), h.config.Listen)
+	return nil
+}
+
+func (h *Router) Stop() {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if h.cancel == nil {
+		return
+	}
+
+	h.listener.Close()
+	h.listener = nil
+
+	if h.http != nil {
+		h.http.Close()
+		h.http = nil
+	}
+
+	if h.transparent != nil {
+		h.transparent.Close()
+		h.transparent = nil
+	}
+
+	if h.dns != nil {
+		h.dns.Close()
+		h.dns = nil
+	}
+
+	h.stopClients()
+
+	h.cancel()
+	h.cancel = nil
+}
+
+func (h *Router) stopClients() {
+	for _, client := range h.Clients {
+		client.Stop()
+	}
+}
+
+func (h *Router) pick(server, host string) *Client {
+	if client := h.client(server); client != nil {
+		return client
+	}
+	return h.Route(host)
+}
+
+func (h *Router) doTransfer(conn *net.TCPConn) {
+	serveLocalSocks5(conn, h.auth, h.rules, h.pick)
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ruleResolveTTL     = time.Minute * 10
+	ruleResolveTimeout = time.Second * 2
+)
+
+type RuleAction int
+
+const (
+	RuleAction_Tunnel RuleAction = iota
+	RuleAction_Direct
+	RuleAction_Reject
+)
+
+var ruleActions = map[string]RuleAction{
+	"tunnel": RuleAction_Tunnel,
+	"direct": RuleAction_Direct,
+	"reject": RuleAction_Reject,
+}
+
+func (h RuleAction) String() string {
+	for k, v := range ruleActions {
+		if v == h {
+			return k
+		}
+	}
+	return "unknown"
+}
+
+type RuleConfig struct {
+	// cidr, domain, keyword, list, port
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Action string `json:"action"`
+	// optional server name for tunnel action in multiple servers mode
+	Server string `json:"server"`
+}
+
+type rule struct {
+	ipNets   []*net.IPNet
+	suffixes []string
+	keyword  string
+	portFrom int
+	portTo   int
+
+	action RuleAction
+	server string
+}
+
+// host is empty for ip destinations, ip is nil for domains not resolved
+func (h *rule) match(host string, ip net.IP, port int) bool {
+	if h.portTo > 0 {
+		return port >= h.portFrom && port <= h.portTo
+	}
+	if h.keyword != "" {
+		return host != "" && strings.Contains(host, h.keyword)
+	}
+	if ip != nil {
+		for _, ipNet := range h.ipNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	if host != "" {
+		for _, suffix := range h.suffixes {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type Rules struct {
+	rules         []*rule
+	defaultAction RuleAction
+	resolver      *ruleResolver
+}
+
+// without resolver the cidr rules only match ip destinations
+func NewRules(cfgs []*RuleConfig, defaultAction string, resolver *ruleResolver) (*Rules, error) {
+	h := &Rules{}
+	h.resolver = resolver
+
+	if defaultAction != "" {
+		action, ok := ruleActions[defaultAction]
+		if !ok {
+			return nil, fmt.Errorf("error rule action %s", defaultAction)
+		}
+		h.defaultAction = action
+	}
+
+	for _, cfg := range cfgs {
+		r, err := newRule(cfg)
+		if err != nil {
+			return nil, err
+		}
+		h.rules = append(h.rules, r)
+	}
+	return h, nil
+}
+
+func newRule(cfg *RuleConfig) (*rule, error) {
+	h := &rule{}
+	h.server = cfg.Server
+
+	action, ok := ruleActions[cfg.Action]
+	if !ok {
+		return nil, fmt.Errorf("error rule action %s", cfg.Action)
+	}
+	h.action = action
+
+	switch cfg.Type {
+	case "cidr":
+		if err := h.addItem(cfg.Value, true); err != nil {
+			return nil, err
+		}
+	case "domain":
+		h.addItem(cfg.Value, false)
+	case "keyword":
+		h.keyword = strings.ToLower(cfg.Value)
+	case "list":
+		if err := h.loadList(cfg.Value); err != nil {
+			return nil, err
+		}
+	case "port":
+		from, to, found := strings.Cut(cfg.Value, "-")
+		var err error
+		if h.portFrom, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+			return nil, fmt.Errorf("error port rule %s", cfg.Value)
+		}
+		h.portTo = h.portFrom
+		if found {
+			if h.portTo, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("error port rule %s", cfg.Value)
+			}
+		}
+		if h.portFrom <= 0 || h.portTo < h.portFrom || h.portTo > 65535 {
+			return nil, fmt.Errorf("error port rule %s", cfg.Value)
+		}
+	default:
+		return nil, fmt.Errorf("error rule type %s", cfg.Type)
+	}
+	return h, nil
+}
+
+func (h *rule) addItem(item string, cidr bool) error {
+	if cidr {
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return err
+		}
+		h.ipNets = append(h.ipNets, ipNet)
+	} else {
+		h.suffixes = append(h.suffixes, strings.ToLower(strings.Trim(item, ".")))
+	}
+	return nil
+}
+
+// list file has one cidr or domain suffix per line, # starts a comment
+func (h *rule) loadList(fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := h.addItem(line, strings.Contains(line, "/")); err != nil {
+			return fmt.Errorf("%s: %+v", fileName, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// returns the action of the first matched rule and its server name
+func (h *Rules) Match(host string, port int) (RuleAction, string) {
+	if h == nil {
+		return RuleAction_Tunnel, ""
+	}
+
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	if ip != nil {
+		host = ""
+	}
+
+	resolved := ip != nil || h.resolver == nil
+	for _, r := range h.rules {
+		if !resolved && len(r.ipNets) > 0 {
+			ip, resolved = h.resolver.Lookup(host), true
+		}
+		if r.match(host, ip, port) {
+			return r.action, r.server
+		}
+	}
+	return h.defaultAction, ""
+}
+
+type ruleResolveItem struct {
+	ip     net.IP
+	expire time.Time
+}
+
+// resolves the domain destinations locally for the cidr rules and routes,
+// the connection itself still sends the domain
+type ruleResolver struct {
+	cache  map[string]*ruleResolveItem
+	locker sync.Mutex
+}
+
+func newRuleResolver() *ruleResolver {
+	h := &ruleResolver{}
+	h.cache = make(map[string]*ruleResolveItem)
+	return h
+}
+
+// nil when the domain can not be resolved, ipv4 preferred
+func (h *ruleResolver) Lookup(host string) net.IP {
+	now := time.Now()
+
+	h.locker.Lock()
+	item, ok := h.cache[host]
+	h.locker.Unlock()
+	if ok && now.Before(item.expire) {
+		return item.ip
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ruleResolveTimeout)
+	defer cancel()
+
+	item = &ruleResolveItem{expire: now.Add(ruleResolveTTL)}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		log.Printf("ruleResolver %s %+v\n", host, err)
+		item.expire = now.Add(dnsNegativeTTL)
+	}
+	for _, ip := range ips {
+		if item.ip == nil || (item.ip.To4() == nil && ip.To4() != nil) {
+			item.ip = ip
+		}
+	}
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if len(h.cache) >= dnsCacheSize {
+		for k, v := range h.cache {
+			if now.After(v.expire) {
+				delete(h.cache, k)
+			}
+		}
+		if len(h.cache) >= dnsCacheSize {
+			h.cache = make(map[string]*ruleResolveItem)
+		}
+	}
+	h.cache[host] = item
+	return item.ip
+}
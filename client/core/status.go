@@ -1,10 +1,8 @@
 package core
 
-import "sync/atomic"
-
-var (
-	Status           = NewClientStatus()
-	publishObservers atomic.Value
+import (
+	"sync"
+	"sync/atomic"
 )
 
 type ClientStatusStep int
@@ -22,61 +20,110 @@ const (
 )
 
 type ClientStatus struct {
-	ping int
-	stat ClientStatusStep
+	ping       int
+	stat       ClientStatusStep
+	reason     string
+	mapTargets []*MapTargetInfo
+
+	observers atomic.Value
+	locker    sync.Mutex
 }
 
 func NewClientStatus() *ClientStatus {
 	h := &ClientStatus{}
-	publishObservers.Store(make([]chan *ClientStatus, 0))
+	h.observers.Store(make([]chan *ClientStatus, 0))
 	return h
 }
 
-func AttachStatusObserver(observer chan *ClientStatus) {
-	observers := publishObservers.Load().([]chan *ClientStatus)
+func (h *ClientStatus) attachObserver(observer chan *ClientStatus) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	observers := h.observers.Load().([]chan *ClientStatus)
 	for _, item := range observers {
 		if item == observer {
 			return
 		}
 	}
-	publishObservers.Store(append(observers, observer))
+	h.observers.Store(append(observers[:len(observers):len(observers)], observer))
 }
 
-func DetachStatusObserver(observer chan *ClientStatus) {
-	observers := publishObservers.Load().([]chan *ClientStatus)
+func (h *ClientStatus) detachObserver(observer chan *ClientStatus) {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	observers := h.observers.Load().([]chan *ClientStatus)
 	for idx, item := range observers {
 		if item == observer {
-			publishObservers.Store(append(observers[:idx], observers[idx+1:]...))
+			list := make([]chan *ClientStatus, 0, len(observers)-1)
+			list = append(list, observers[:idx]...)
+			h.observers.Store(append(list, observers[idx+1:]...))
 			return
 		}
 	}
 }
 
 func (h *ClientStatus) GetStat() ClientStatusStep {
+	h.locker.Lock()
+	defer h.locker.Unlock()
 	return h.stat
 }
 
 func (h *ClientStatus) GetPing() int {
+	h.locker.Lock()
+	defer h.locker.Unlock()
 	return h.ping
 }
 
+func (h *ClientStatus) GetReason() string {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return h.reason
+}
+
+func (h *ClientStatus) GetMapTargets() []*MapTargetInfo {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	return h.mapTargets
+}
+
 func (h *ClientStatus) notifyChanged() {
-	data := *h
-	observers := publishObservers.Load().([]chan *ClientStatus)
+	h.locker.Lock()
+	data := &ClientStatus{ping: h.ping, stat: h.stat, reason: h.reason, mapTargets: h.mapTargets}
+	h.locker.Unlock()
+
+	observers := h.observers.Load().([]chan *ClientStatus)
 	for _, observer := range observers {
 		select {
-		case observer <- &data:
+		case observer <- data:
 		default:
 		}
 	}
 }
 
 func (h *ClientStatus) setStat(stat ClientStatusStep) {
+	h.locker.Lock()
 	h.stat = stat
+	h.locker.Unlock()
 	h.notifyChanged()
 }
 
 func (h *ClientStatus) setPing(ping int) {
+	h.locker.Lock()
 	h.ping = ping
+	h.locker.Unlock()
 	h.notifyChanged()
 }
+
+func (h *ClientStatus) setMapTargets(mapTargets []*MapTargetInfo) {
+	h.locker.Lock()
+	h.mapTargets = mapTargets
+	h.locker.Unlock()
+	h.notifyChanged()
+}
+
+func (h *ClientStatus) setReason(reason string) {
+	h.locker.Lock()
+	h.reason = reason
+	h.locker.Unlock()
+}
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+var (
+	ErrTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+)
+
+// accepts connections redirected by iptables REDIRECT or TPROXY and tunnels
+// them to their original destination
+type TransparentProxy struct {
+	listener *net.TCPListener
+	tproxy   bool
+	auth     *LocalAuth
+	dial     func(host string, port int) (net.Conn, error)
+}
+
+// mode is redirect (default) or tproxy
+func NewTransparentProxy(addr string, mode string, auth *LocalAuth, dial func(host string, port int) (net.Conn, error)) (*TransparentProxy, error) {
+	h := &TransparentProxy{}
+	h.auth = auth
+	h.dial = dial
+
+	switch mode {
+	case "", "redirect":
+	case "tproxy":
+		h.tproxy = true
+	default:
+		return nil, errors.New("error transparent mode " + mode)
+	}
+
+	var err error
+	if h.listener, err = listenTransparent(addr, h.tproxy); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *TransparentProxy) Serve() {
+	for {
+		conn, err := h.listener.AcceptTCP()
+		if err != nil {
+			log.Printf("TransparentProxy AcceptTCP exit: %+v\n", err)
+			return
+		}
+
+		go h.doTransfer(conn)
+	}
+}
+
+func (h *TransparentProxy) Close() {
+	h.listener.Close()
+}
+
+func (h *TransparentProxy) doTransfer(conn *net.TCPConn) {
+	if !h.auth.AllowAddr(conn.RemoteAddr()) {
+		conn.Close()
+		log.Printf("TransparentProxy source not allowed %s\n", conn.RemoteAddr().String())
+		return
+	}
+
+	dst, err := originalDst(conn, h.tproxy)
+	if err != nil {
+		conn.Close()
+		log.Printf("TransparentProxy originalDst: %+v\n", err)
+		return
+	}
+
+	// connecting the listener itself would loop forever
+	if local, ok := h.listener.Addr().(*net.TCPAddr); ok && dst.Port == local.Port && (dst.IP.IsLoopback() || dst.IP.Equal(local.IP)) {
+		conn.Close()
+		log.Printf("TransparentProxy refuse loop %s\n", dst.String())
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	remote, err := h.dial(dst.IP.String(), dst.Port)
+	if err != nil {
+		conn.Close()
+		log.Printf("TransparentProxy dial %s: %+v\n", dst.String(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	remote.SetDeadline(time.Time{})
+
+	log.Printf("TransparentProxy %s -> %s\n", conn.RemoteAddr().String(), net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port)))
+	go nctst.Transfer(conn, remote)
+}
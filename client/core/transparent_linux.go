@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	soOriginalDst     = 80 // linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // linux/netfilter_ipv6/ip6_tables.h
+)
+
+func listenTransparent(addr string, tproxy bool) (*net.TCPListener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				} else {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+
+	listener, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
+
+// with TPROXY the socket keeps the original destination as local address,
+// with REDIRECT it is read from conntrack by SO_ORIGINAL_DST
+func originalDst(conn *net.TCPConn, tproxy bool) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if tproxy {
+		return local, nil
+	}
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst); sockErr == nil {
+				// struct sockaddr_in
+				addr := (*unix.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+				dst = &net.TCPAddr{IP: net.IP(addr.Addr[:]).To16(), Port: int(ntohs(addr.Port))}
+			}
+		} else {
+			var info *unix.IPv6MTUInfo
+			if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); sockErr == nil {
+				dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(ntohs(info.Addr.Port))}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return dst, nil
+}
+
+// the port in sockaddr is in network byte order
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return binary.BigEndian.Uint16(b[:])
+}
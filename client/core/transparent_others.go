@@ -0,0 +1,13 @@
+//go:build !linux
+
+package core
+
+import "net"
+
+func listenTransparent(addr string, tproxy bool) (*net.TCPListener, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func originalDst(conn *net.TCPConn, tproxy bool) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
@@ -0,0 +1,174 @@
+package core
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+const (
+	udpSessionIdleTimeout = time.Minute * 2
+)
+
+type udpSession struct {
+	peer       *net.UDPAddr
+	stream     net.Conn
+	lastActive atomic.Int64
+}
+
+// forwards the datagrams of a local udp port, every peer address gets its own
+// relay stream so the replies go back to the right peer
+type udpMapTarget struct {
+	client *Client
+	target string
+	conn   *net.UDPConn
+
+	sessions map[string]*udpSession
+	locker   sync.Mutex
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newUDPMapTarget(client *Client, target string, conn *net.UDPConn) *udpMapTarget {
+	h := &udpMapTarget{}
+	h.client = client
+	h.target = target
+	h.conn = conn
+	h.sessions = make(map[string]*udpSession)
+	h.die = make(chan struct{})
+
+	go h.readLoop()
+	go h.cleanLoop()
+	return h
+}
+
+func (h *udpMapTarget) Close() error {
+	h.dieOnce.Do(func() {
+		close(h.die)
+	})
+
+	err := h.conn.Close()
+
+	h.locker.Lock()
+	for key, session := range h.sessions {
+		session.stream.Close()
+		delete(h.sessions, key)
+	}
+	h.locker.Unlock()
+	return err
+}
+
+func (h *udpMapTarget) readLoop() {
+	buf := make([]byte, nctst.UDP_PACKET_SIZE)
+	for {
+		n, peer, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("udpMapTarget ReadFromUDP: %+v\n", err)
+			return
+		}
+
+		session, err := h.getSession(peer)
+		if err != nil {
+			log.Printf("udpMapTarget open session %s: %+v\n", peer.String(), err)
+			continue
+		}
+
+		session.lastActive.Store(time.Now().UnixNano())
+		if err = nctst.WriteUDPPacket(session.stream, buf[:n]); err != nil {
+			h.removeSession(peer.String(), session)
+		}
+	}
+}
+
+func (h *udpMapTarget) getSession(peer *net.UDPAddr) (*udpSession, error) {
+	key := peer.String()
+
+	h.locker.Lock()
+	session, ok := h.sessions[key]
+	h.locker.Unlock()
+	if ok {
+		return session, nil
+	}
+
+	stream, err := h.client.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	if err = nctst.WriteUDPRelayHeader(stream, h.target); err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	session = &udpSession{}
+	session.peer = peer
+	session.stream = stream
+	session.lastActive.Store(time.Now().UnixNano())
+
+	h.locker.Lock()
+	select {
+	case <-h.die:
+		h.locker.Unlock()
+		stream.Close()
+		return nil, ErrClientNotRunning
+	default:
+	}
+	h.sessions[key] = session
+	h.locker.Unlock()
+
+	log.Printf("udpMapTarget new session %s -> %s\n", key, h.target)
+	go h.sessionLoop(key, session)
+	return session, nil
+}
+
+func (h *udpMapTarget) sessionLoop(key string, session *udpSession) {
+	defer h.removeSession(key, session)
+
+	buf := make([]byte, nctst.UDP_PACKET_SIZE)
+	for {
+		n, err := nctst.ReadUDPPacket(session.stream, buf)
+		if err != nil {
+			return
+		}
+
+		session.lastActive.Store(time.Now().UnixNano())
+		if _, err = h.conn.WriteToUDP(buf[:n], session.peer); err != nil {
+			return
+		}
+	}
+}
+
+func (h *udpMapTarget) removeSession(key string, session *udpSession) {
+	h.locker.Lock()
+	if h.sessions[key] == session {
+		delete(h.sessions, key)
+	}
+	h.locker.Unlock()
+
+	session.stream.Close()
+}
+
+func (h *udpMapTarget) cleanLoop() {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.die:
+			return
+		case <-ticker.C:
+			h.locker.Lock()
+			for key, session := range h.sessions {
+				if time.Since(time.Unix(0, session.lastActive.Load())) > udpSessionIdleTimeout {
+					delete(h.sessions, key)
+					session.stream.Close()
+				}
+			}
+			h.locker.Unlock()
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -15,7 +18,7 @@ import (
 )
 
 var (
-	authCode   int
+	authCodes  []int
 	configFile string
 	config     *core.Config
 )
@@ -24,11 +27,18 @@ func init() {
 	rand.Seed(time.Now().Unix())
 	nctst.OpenLog()
 
-	flag.IntVar(&authCode, "d", 0, "auth code")
+	var authCode string
+	flag.StringVar(&authCode, "d", "0", "auth code, comma separated in servers order for multiple servers")
 	flag.StringVar(&configFile, "c", "", "configure file")
 	flag.Parse()
 
-	if authCode == 0 {
+	for _, s := range strings.Split(authCode, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		nctst.CheckError(err)
+		authCodes = append(authCodes, code)
+	}
+
+	if authCodes[0] == 0 {
 		log.Println("Attention, no auth code. Only test environment can work.")
 	}
 
@@ -48,7 +58,55 @@ func init() {
 }
 
 func main() {
-	nctst.CheckError(core.Start(config, authCode))
+	if len(config.Servers) > 0 {
+		runRouter()
+		return
+	}
+
+	client := core.NewClient(config, authCodes[0])
+
+	observer := make(chan *core.ClientStatus, 8)
+	client.AttachStatusObserver(observer)
+
+	nctst.CheckError(client.Start(context.Background()))
+	defer client.Stop()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-sigCh:
+			return
+		case <-client.Done():
+			return
+		case status := <-observer:
+			if status.GetStat() == core.ClientStatusStep_Failed {
+				log.Printf("client stopped: %s\n", status.GetReason())
+				return
+			}
+		}
+	}
+}
+
+func runRouter() {
+	router, err := core.NewRouter(config, authCodes)
+	nctst.CheckError(err)
+
+	for _, client := range router.Clients {
+		observer := make(chan *core.ClientStatus, 8)
+		client.AttachStatusObserver(observer)
+		go func(name string) {
+			for status := range observer {
+				if status.GetStat() == core.ClientStatusStep_Failed {
+					log.Printf("server %s stopped: %s\n", name, status.GetReason())
+				}
+			}
+		}(client.Config().Name)
+	}
+
+	nctst.CheckError(router.Start(context.Background()))
+	defer router.Stop()
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
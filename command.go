@@ -14,6 +14,8 @@ const (
 )
 
 var (
+	// the key of SendCommand and ReadCommand, the tunnels of a client with
+	// several servers use the key of their own server
 	CommandXorKey string
 )
 
@@ -32,6 +34,8 @@ const (
 	Cmd_handshake
 	Cmd_handshakeReply
 	Cmd_ping
+	Cmd_kickout
+	Cmd_testspeed
 
 	Cmd_max
 )
@@ -39,6 +43,8 @@ const (
 type CommandManager struct {
 	CommandReceiveChan chan *BufItem
 
+	key string
+
 	commandPublishObservers []chan *Command
 	commandPublishLocker    sync.Mutex
 
@@ -47,8 +53,9 @@ type CommandManager struct {
 	dieOnce sync.Once
 }
 
-func NewCommandManager() *CommandManager {
+func NewCommandManager(key string) *CommandManager {
 	h := &CommandManager{}
+	h.key = key
 	h.CommandReceiveChan = make(chan *BufItem, 8)
 	h.commandPublishObservers = make([]chan *Command, 0)
 
@@ -100,7 +107,7 @@ func (h *CommandManager) commandDaemon() {
 		case <-h.Die:
 			return
 		case buf := <-h.CommandReceiveChan:
-			if cmd, err := ReadCommand(buf); err == nil {
+			if cmd, err := ReadCommandWithKey(buf, h.key); err == nil {
 				h.publishCommand(cmd)
 			} else {
 				log.Printf("CommandDaemon CommandFromBuf error: %+v %d\n", err, buf.Size())
@@ -125,6 +132,10 @@ func (h *CommandManager) publishCommand(cmd *Command) {
 }
 
 func SendCommand(conn io.Writer, command *Command) error {
+	return SendCommandWithKey(conn, command, CommandXorKey)
+}
+
+func SendCommandWithKey(conn io.Writer, command *Command, key string) error {
 	if command.Type == Cmd_idle {
 		randBytes := make([]byte, 256+rand.Intn(256))
 		rand.Read(randBytes)
@@ -136,7 +147,7 @@ func SendCommand(conn io.Writer, command *Command) error {
 		return err
 	}
 	data := []byte(js)
-	Xor(data, []byte(CommandXorKey))
+	Xor(data, []byte(key))
 
 	if err := WriteUInt(conn, uint32(len(data)+12)); err != nil {
 		return err
@@ -184,12 +195,16 @@ func GetCommandType(buf *BufItem) CommandType {
 }
 
 func ReadCommand(buf *BufItem) (*Command, error) {
+	return ReadCommandWithKey(buf, CommandXorKey)
+}
+
+func ReadCommandWithKey(buf *BufItem, key string) (*Command, error) {
 	if sign, _ := ReadUInt64(buf); sign != commandSignHeader {
 		return nil, fmt.Errorf("CommandSignHeader error %d", sign)
 	}
 
 	t, _ := ReadUInt(buf)
-	Xor(buf.Data(), []byte(CommandXorKey))
+	Xor(buf.Data(), []byte(key))
 	s := string(buf.Data())
 
 	var obj interface{}
@@ -210,6 +225,10 @@ func ReadCommand(buf *BufItem) (*Command, error) {
 		obj = &CommandHandshakeReply{}
 	case Cmd_ping:
 		obj = &CommandPing{}
+	case Cmd_kickout:
+		obj = &CommandKickout{}
+	case Cmd_testspeed:
+		obj = &CommandTestSpeed{}
 	default:
 		return nil, fmt.Errorf("CommandFromBuf error type: %d", t)
 	}
@@ -233,6 +252,15 @@ type Command struct {
 	Type   CommandType
 	Target CommandTarget
 	Item   interface{}
+
+	// closed when a connection wrote the command, see OuterTunnel.SendCommandWait
+	sent chan struct{}
+}
+
+func (h *Command) markSent() {
+	if h.sent != nil {
+		close(h.sent)
+	}
 }
 
 type CommandIdle struct {
@@ -243,11 +271,18 @@ type CommandTestPing struct {
 	SendTime int64
 }
 
+// the client sends Upload bytes, the server replies the command then sends Download bytes
+type CommandTestSpeed struct {
+	Upload   int
+	Download int
+}
+
 type CommandLogin struct {
 	AuthCode   int
 	ClientUUID string
 	UserName   string
 	PassWord   string
+	Device     string
 	Compress   bool
 	Key        string
 }
@@ -300,3 +335,8 @@ type CommandPing struct {
 	Step     uint
 	SendTime int64
 }
+
+type CommandKickout struct {
+	ClientUUID string
+	Reason     string
+}
@@ -24,6 +24,9 @@ import (
 var (
 	DataBufPool          = NewPool(DATA_BUF_SIZE)
 	DelayCloseNum uint32 = 0
+
+	ErrTransferFirstClosed  = errors.New("first endpoint closed")
+	ErrTransferSecondClosed = errors.New("second endpoint closed")
 )
 
 type BuffersWriter interface {
@@ -60,30 +63,40 @@ func OpenLog() {
 
 var _copy_buf_pool = NewPool(1024 * 512)
 
-func Transfer(p1, p2 io.ReadWriteCloser) {
-	TransferWithCounter(p1, p2, nil, nil)
+func Transfer(p1, p2 io.ReadWriteCloser) error {
+	return TransferWithCounter(p1, p2, nil, nil)
 }
 
-func TransferWithCounter(p1, p2 io.ReadWriteCloser, wl1, wl2 *atomic.Int64) {
-	streamCopy := func(to, from io.ReadWriteCloser, l *atomic.Int64) {
+// TransferWithCounter returns the reason of the direction which finished first,
+// ErrTransferFirstClosed or ErrTransferSecondClosed when it ended by EOF
+func TransferWithCounter(p1, p2 io.ReadWriteCloser, wl1, wl2 Counter) error {
+	errCh := make(chan error, 2)
+	streamCopy := func(to, from io.ReadWriteCloser, l Counter, eof error) {
 		defer to.Close()
 		defer from.Close()
 
 		buf := _copy_buf_pool.Get()
 		defer buf.Release()
 
+		var err error
 		if l == nil {
-			io.CopyBuffer(to, from, buf.data)
+			_, err = io.CopyBuffer(to, from, buf.data)
 		} else {
-			CopyBufferWithCounter(to, from, buf.data, l)
+			_, err = CopyBufferWithCounter(to, from, buf.data, l)
+		}
+
+		if err == nil {
+			err = eof
 		}
+		errCh <- err
 	}
 
-	go streamCopy(p1, p2, wl1)
-	streamCopy(p2, p1, wl2)
+	go streamCopy(p1, p2, wl1, ErrTransferSecondClosed)
+	streamCopy(p2, p1, wl2, ErrTransferFirstClosed)
+	return <-errCh
 }
 
-func CopyBufferWithCounter(dst io.Writer, src io.Reader, buf []byte, wl *atomic.Int64) (written int64, err error) {
+func CopyBufferWithCounter(dst io.Writer, src io.Reader, buf []byte, wl Counter) (written int64, err error) {
 	for {
 		nr, er := src.Read(buf)
 		if nr > 0 {
@@ -14,6 +14,15 @@ const (
 	KCP_UDP_SEND_BUF_NUM    = 1024
 
 	NEW_CONNECTION_KEY uint32 = 0xFFEEFF
+
+	// first bytes of the non socks smux streams, the first byte 0 never starts a socks handshake
+	UDP_RELAY_KEY   uint32 = 0xEEFFEE
+	REVERSE_KEY     uint32 = 0xEEFFEF
+	DNS_RELAY_KEY   uint32 = 0xEEFFF0
+	UDP_PACKET_SIZE        = 1024 * 64
+
+	// the download of a speed test, served before login so kept small
+	TEST_SPEED_MAX_SIZE = 1024 * 1024 * 2
 )
 
 type AddrInfo struct {
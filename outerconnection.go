@@ -20,23 +20,32 @@ type OuterConnection struct {
 	commandChan        chan *Command
 	commandReceiveChan chan *BufItem
 
+	receiveCounter Counter
+	sendCounter    Counter
+
+	key string
+
 	dieOnce sync.Once
 }
 
-func NewOuterConnection(clientID uint, tunnelID uint, id uint, conn io.ReadWriteCloser,
+func NewOuterConnection(key string, clientID uint, tunnelID uint, id uint, conn io.ReadWriteCloser,
 	receiveChan chan *BufItem, sendChan chan *BufItem,
-	commandChan chan *Command, commandReceiveChan chan *BufItem) *OuterConnection {
+	commandChan chan *Command, commandReceiveChan chan *BufItem,
+	receiveCounter Counter, sendCounter Counter) *OuterConnection {
 
 	h := &OuterConnection{}
 	h.ID = id
 	h.ClientID = clientID
 	h.TunnelID = tunnelID
+	h.key = key
 
 	h.conn = conn
 	h.receiveChan = receiveChan
 	h.sendChan = sendChan
 	h.commandChan = commandChan
 	h.commandReceiveChan = commandReceiveChan
+	h.receiveCounter = receiveCounter
+	h.sendCounter = sendCounter
 
 	h.Die = make(chan struct{})
 	once := &sync.Once{}
@@ -64,7 +73,9 @@ outfor:
 		select {
 		case cmd := <-h.commandChan:
 			time.Sleep(time.Second)
-			SendCommand(h.conn, cmd)
+			if SendCommandWithKey(h.conn, cmd, h.key) == nil {
+				cmd.markSent()
+			}
 		default:
 			break outfor
 		}
@@ -88,6 +99,10 @@ func (h *OuterConnection) receiveLoop(conn io.ReadWriteCloser, once *sync.Once)
 			return
 		}
 
+		if h.receiveCounter != nil {
+			h.receiveCounter.Add(int64(buf.Size()))
+		}
+
 		if IsCommand(buf) {
 			select {
 			case h.commandReceiveChan <- buf:
@@ -116,17 +131,21 @@ func (h *OuterConnection) sendLoop(conn io.ReadWriteCloser, once *sync.Once) {
 		case <-h.Die:
 			return
 		case buf := <-h.sendChan:
-			_, err := conn.Write(buf.Data())
+			n, err := conn.Write(buf.Data())
 			buf.Release()
+			if h.sendCounter != nil {
+				h.sendCounter.Add(int64(n))
+			}
 			if err != nil {
 				log.Printf("sendLoop WriteUInt error: %d %d %d %+v\n", h.ClientID, h.TunnelID, h.ID, err)
 				return
 			}
 		case command := <-h.commandChan:
-			if err := SendCommand(conn, command); err != nil {
+			if err := SendCommandWithKey(conn, command, h.key); err != nil {
 				log.Printf("sendLoop SendCommand error: %d %d %d %+v\n", h.ClientID, h.TunnelID, h.ID, err)
 				return
 			}
+			command.markSent()
 		}
 	}
 }
@@ -15,6 +15,9 @@ type OuterTunnel struct {
 	Ping  int64
 	Speed int
 
+	ReceiveSpeed *SpeedCounter
+	SendSpeed    *SpeedCounter
+
 	connections       map[uint]*OuterConnection
 	connectionsLocker sync.Mutex
 
@@ -29,6 +32,8 @@ type OuterTunnel struct {
 
 	logoutNotify chan string
 
+	key string
+
 	DirectChan chan *BufItem
 
 	CommandManager *CommandManager
@@ -42,9 +47,13 @@ func NewOuterTunnel(key string, id uint, clientID uint, receiveChan chan *BufIte
 	h := &OuterTunnel{}
 	h.ID = id
 	h.ClientID = clientID
+	h.key = key
 
 	h.connections = make(map[uint]*OuterConnection)
 
+	h.ReceiveSpeed = NewSpeedCounter()
+	h.SendSpeed = NewSpeedCounter()
+
 	h.commandSendChan = make(chan *Command, 8)
 	h.commandReceiveChan = make(chan *Command, 8)
 	h.receiveChan = receiveChan
@@ -54,7 +63,7 @@ func NewOuterTunnel(key string, id uint, clientID uint, receiveChan chan *BufIte
 
 	h.logoutNotify = logoutNotify
 
-	h.CommandManager = NewCommandManager()
+	h.CommandManager = NewCommandManager(key)
 
 	h.Die = make(chan struct{})
 
@@ -81,7 +90,13 @@ func (h *OuterTunnel) Close() {
 
 	h.CommandManager.DetachCommandObserver(h.commandReceiveChan)
 	h.CommandManager.Close()
-	h.RemoveAllConn()
+
+	h.connectionsLocker.Lock()
+	for _, v := range h.connections {
+		v.Close()
+	}
+	h.connections = make(map[uint]*OuterConnection)
+	h.connectionsLocker.Unlock()
 
 	log.Printf("OuterTunnel.Close %d %d\n", h.ClientID, h.ID)
 }
@@ -105,7 +120,7 @@ func (h *OuterTunnel) AddConn(conn io.ReadWriteCloser, id uint) (outerConn *Oute
 		return
 	}
 
-	outer := NewOuterConnection(h.ClientID, h.ID, id, conn, h.receiveChan, h.outputChan, h.commandSendChan, h.CommandManager.CommandReceiveChan)
+	outer := NewOuterConnection(h.key, h.ClientID, h.ID, id, conn, h.receiveChan, h.outputChan, h.commandSendChan, h.CommandManager.CommandReceiveChan, h.ReceiveSpeed, h.SendSpeed)
 	h.connections[id] = outer
 
 	return outer
@@ -125,6 +140,13 @@ func (h *OuterTunnel) RemoveConn(id uint) {
 	}
 }
 
+func (h *OuterTunnel) ConnNum() int {
+	h.connectionsLocker.Lock()
+	defer h.connectionsLocker.Unlock()
+
+	return len(h.connections)
+}
+
 func (h *OuterTunnel) RemoveAllConn() {
 	h.connectionsLocker.Lock()
 	defer h.connectionsLocker.Unlock()
@@ -158,13 +180,22 @@ func (h *OuterTunnel) transferLoop() {
 }
 
 func (h *OuterTunnel) daemon() {
+	pingTimer := time.NewTimer(time.Second * time.Duration(rand.Intn(60)+60))
+	defer pingTimer.Stop()
+
+	speedTicker := time.NewTicker(time.Second * 2)
+	defer speedTicker.Stop()
+
 	for {
-		ticker := time.NewTicker(time.Second * time.Duration(rand.Intn(60)+60))
 		select {
 		case <-h.Die:
 			return
-		case <-ticker.C:
+		case <-pingTimer.C:
 			h.startPing()
+			pingTimer.Reset(time.Second * time.Duration(rand.Intn(60)+60))
+		case <-speedTicker.C:
+			h.ReceiveSpeed.Sample()
+			h.SendSpeed.Sample()
 		case command := <-h.commandReceiveChan:
 			h.onReceiveCommand(command)
 		}
@@ -192,12 +223,39 @@ func (h *OuterTunnel) SendCommand(command *Command) {
 	}
 }
 
+// queues the command and waits until a connection wrote it, false on timeout
+func (h *OuterTunnel) SendCommandWait(command *Command, timeout time.Duration) bool {
+	command.sent = make(chan struct{})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-h.Die:
+		return false
+	case <-timer.C:
+		return false
+	case h.commandSendChan <- command:
+	}
+
+	select {
+	case <-h.Die:
+		return false
+	case <-timer.C:
+		return false
+	case <-command.sent:
+		return true
+	}
+}
+
 func (h *OuterTunnel) onReceiveCommand(command *Command) {
 	switch command.Type {
 	case Cmd_ping:
 		h.onReceivePing(command.Item.(*CommandPing))
 	case Cmd_logout:
-		h.logoutNotify <- command.Item.(*CommandLogout).UserName
+		if h.logoutNotify != nil {
+			h.logoutNotify <- command.Item.(*CommandLogout).ClientUUID
+		}
 	}
 }
 
@@ -0,0 +1,43 @@
+package proxyclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dials the proxy server, through the via proxy when set,
+// the via proxy connects to this server as its target
+func dialServer(server *ProxyInfo, timeout time.Duration) (net.Conn, error) {
+	if server.Via == nil {
+		return net.DialTimeout("tcp", server.Address(), timeout)
+	}
+
+	via := NewProxyClient(server.Via, &server.AddrInfo)
+	if via == nil {
+		return nil, fmt.Errorf("via unknown proxy type %s", server.Via.Type)
+	}
+	if err := via.Connect(); err != nil {
+		return nil, fmt.Errorf("via %s %s: %w", server.Via.Name, server.Via.Address(), err)
+	}
+	return via, nil
+}
+
+func dialTLS(server *ProxyInfo, conf *tls.Config) (net.Conn, error) {
+	raw, err := dialServer(server, time.Second*2)
+	if err != nil {
+		return nil, err
+	}
+
+	return handshakeTLS(server, raw, conf)
+}
+
+// the address followed by the via proxies, for logs
+func (h *ProxyInfo) Chain() string {
+	chain := h.Address()
+	for via := h.Via; via != nil; via = via.Via {
+		chain += " via " + via.Address()
+	}
+	return chain
+}
@@ -1,7 +1,6 @@
 package proxyclient
 
 import (
-	"net"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -23,7 +22,7 @@ func (h *DirectClient) Connect() error {
 		h.Conn.Close()
 		h.Conn = nil
 	}
-	conn, err := net.DialTimeout("tcp", h.Server.Address(), time.Second*5)
+	conn, err := dialServer(h.Server, time.Second*5)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,102 @@
+package proxyclient
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+// CONNECT through a http proxy, https connects to the proxy with tls,
+// the tls params see newTLSConfig
+type HTTPClient struct {
+	proxyClient
+
+	TLS bool
+}
+
+func NewHTTPClient(server *ProxyInfo, target *nctst.AddrInfo, useTLS bool) ProxyClient {
+	h := &HTTPClient{}
+	h.Server = server
+	h.Target = target
+	h.TLS = useTLS
+	return h
+}
+
+func (h *HTTPClient) Connect() error {
+	if h.Conn != nil {
+		h.Conn.Close()
+		h.Conn = nil
+	}
+
+	var conn net.Conn
+	var err error
+	if h.TLS {
+		var conf *tls.Config
+		if conf, err = newTLSConfig(h.Server, ""); err != nil {
+			return err
+		}
+		conn, err = dialTLS(h.Server, httpOverTLS(conf))
+	} else {
+		conn, err = dialServer(h.Server, time.Second*2)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: h.Target.Address()},
+		Host:   h.Target.Address(),
+		Header: http.Header{},
+	}
+	if len(h.Server.LoginName) > 0 {
+		request.SetBasicAuth(h.Server.LoginName, h.Server.Password)
+		request.Header.Set("Proxy-Authorization", request.Header.Get("Authorization"))
+		request.Header.Del("Authorization")
+	}
+
+	if err = request.Write(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return fmt.Errorf("http proxy CONNECT %s: %s", h.Target.Address(), response.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// the proxy may send data right after the response
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, reader: reader}
+	}
+
+	h.Conn = conn
+	return nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (h *bufferedConn) Read(p []byte) (int, error) {
+	return h.reader.Read(p)
+}
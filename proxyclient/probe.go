@@ -0,0 +1,194 @@
+package proxyclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+const (
+	probeDefaultSamples   = 3
+	probeDefaultSpeedSize = 256 * 1024
+
+	// the score is the estimated ms to fetch this many bytes
+	scoreReferenceSize = 1024 * 1024
+	// transfer ms when the server has no speed test
+	scoreUnknownTransfer = 5000
+	scoreFailed          = math.MaxFloat32
+
+	// retries when the server is busy with other speed tests
+	probeBusyRetries = 2
+	probeBusyPause   = time.Second * 2
+)
+
+// several pings and a speed test, sets Ping (average), Jitter, SuccessRate,
+// Throughput and Score, lower scores are better
+func Probe(server *ProxyInfo, pingTarget *PingTarget, printDetails bool) bool {
+	printf := func(format string, a ...any) {
+		if printDetails {
+			fmt.Printf(format, a...)
+		}
+	}
+
+	samples := pingTarget.PingSamples
+	if samples <= 0 {
+		samples = probeDefaultSamples
+	}
+
+	server.Jitter = 0
+	server.Throughput = 0
+	server.SuccessRate = 0
+	server.Score = scoreFailed
+
+	pings := make([]uint32, 0, samples)
+	for i := 0; i < samples; i++ {
+		client := NewProxyClient(server, pingTarget.Target)
+		if client == nil {
+			return false
+		}
+		if client.Ping(client, pingTarget.Key, printDetails, nil) {
+			pings = append(pings, server.Ping)
+		}
+	}
+
+	server.SuccessRate = float32(len(pings)) / float32(samples)
+	if len(pings) == 0 {
+		server.Ping = 100000
+		return false
+	}
+
+	server.Ping, server.Jitter = pingStats(pings)
+
+	busy := false
+	if size := pingTarget.SpeedTestSize; size >= 0 {
+		if size == 0 {
+			size = probeDefaultSpeedSize
+		}
+		size = nctst.Min(size, nctst.TEST_SPEED_MAX_SIZE)
+
+		for i := 0; ; i++ {
+			client := NewProxyClient(server, pingTarget.Target)
+			if client == nil {
+				break
+			}
+			throughput, err := client.SpeedTest(client, pingTarget.Key, size)
+			if err == ErrSpeedTestBusy && i < probeBusyRetries {
+				printf("SpeedTest Busy %s, retry\n", server.Address())
+				time.Sleep(probeBusyPause * time.Duration(i+1))
+				continue
+			}
+
+			if err != nil {
+				busy = err == ErrSpeedTestBusy
+				printf("SpeedTest Failed %s %+v\n", server.Address(), err)
+			} else {
+				server.Throughput = throughput
+				printf("SpeedTestResult %s %dKB/s\n", server.Address(), throughput/1024)
+			}
+			break
+		}
+	}
+
+	server.Score = probeScore(server, busy)
+	return true
+}
+
+// average and mean difference between successive samples
+func pingStats(pings []uint32) (uint32, uint32) {
+	var sum, diff float64
+	for i, ping := range pings {
+		sum += float64(ping)
+		if i > 0 {
+			diff += math.Abs(float64(ping) - float64(pings[i-1]))
+		}
+	}
+
+	jitter := 0.0
+	if len(pings) > 1 {
+		jitter = diff / float64(len(pings)-1)
+	}
+	return uint32(sum / float64(len(pings))), uint32(jitter)
+}
+
+// a busy server still has the speed test, its score leaves the transfer out
+// instead of the unknown transfer penalty
+func probeScore(server *ProxyInfo, busy bool) float32 {
+	transfer := float64(scoreUnknownTransfer)
+	if server.Throughput > 0 {
+		transfer = scoreReferenceSize * 1000 / float64(server.Throughput)
+	} else if busy {
+		transfer = 0
+	}
+
+	score := (float64(server.Ping) + 2*float64(server.Jitter) + transfer) / float64(server.SuccessRate)
+	return float32(math.Min(score, scoreFailed))
+}
+
+// nodes are identified by type, address and a digest of the credentials and
+// params in the caches and reports, entries on one address are different nodes
+func (h *ProxyInfo) NodeID() string {
+	data, _ := json.Marshal(&struct {
+		LoginName string            `json:"loginname"`
+		Password  string            `json:"password"`
+		Params    map[string]string `json:"params"`
+		Via       *ProxyInfo        `json:"via"`
+	}{h.LoginName, h.Password, h.Params, h.Via})
+	sum := sha256.Sum256(data)
+	return h.Type + "://" + h.Address() + "#" + hex.EncodeToString(sum[:6])
+}
+
+// measurements of a node, cached by the clients and reported to the server
+type ProxyProbeResult struct {
+	Node        string    `json:"node"`
+	Name        string    `json:"name"`
+	Ping        uint32    `json:"ping"`
+	Jitter      uint32    `json:"jitter"`
+	Throughput  uint32    `json:"throughput"`
+	SuccessRate float32   `json:"successrate"`
+	Score       float32   `json:"score"`
+	Time        time.Time `json:"time"`
+}
+
+type ProxyProbeReport struct {
+	Version string              `json:"ver"`
+	Results []*ProxyProbeResult `json:"results"`
+}
+
+// reports of a node from one office (user and ip) aggregated by the server
+type ProxyProbeStat struct {
+	Node        string    `json:"node"`
+	UserName    string    `json:"username"`
+	IP          string    `json:"ip"`
+	Count       int       `json:"count"`
+	Ping        uint32    `json:"ping"`
+	Throughput  uint32    `json:"throughput"`
+	SuccessRate float32   `json:"successrate"`
+	LastTime    time.Time `json:"lasttime"`
+}
+
+func NewProxyProbeResult(server *ProxyInfo) *ProxyProbeResult {
+	return &ProxyProbeResult{
+		Node:        server.NodeID(),
+		Name:        server.Name,
+		Ping:        server.Ping,
+		Jitter:      server.Jitter,
+		Throughput:  server.Throughput,
+		SuccessRate: server.SuccessRate,
+		Score:       server.Score,
+		Time:        server.PingTime,
+	}
+}
+
+func (h *ProxyProbeResult) Apply(server *ProxyInfo) {
+	server.Ping = h.Ping
+	server.Jitter = h.Jitter
+	server.Throughput = h.Throughput
+	server.SuccessRate = h.SuccessRate
+	server.Score = h.Score
+	server.PingTime = h.Time
+}
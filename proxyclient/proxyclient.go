@@ -5,17 +5,22 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
 	"time"
 
 	"github.com/PIngBZ/nctst"
 )
 
+// the server replied zero sizes, too many speed tests from this ip or in total
+var ErrSpeedTestBusy = errors.New("speed test busy")
+
 type ProxyClient interface {
 	net.Conn
 
 	Connect() error
-	Ping(self ProxyClient, printDetails bool, finished func(ProxyClient, uint32, error)) bool
+	Ping(self ProxyClient, key string, printDetails bool, finished func(ProxyClient, uint32, error)) bool
+	SpeedTest(self ProxyClient, key string, size int) (uint32, error)
 	LastPing() uint32
 }
 
@@ -26,6 +31,16 @@ func NewProxyClient(server *ProxyInfo, target *nctst.AddrInfo) ProxyClient {
 		return NewTrojanClient(server, target)
 	} else if server.Type == "ssr" {
 		return NewSSRClient(server, target)
+	} else if server.Type == "ss" {
+		return NewSSClient(server, target)
+	} else if server.Type == "vmess" {
+		return NewVMessClient(server, target)
+	} else if server.Type == "vless" {
+		return NewVLESSClient(server, target)
+	} else if server.Type == "http" {
+		return NewHTTPClient(server, target, false)
+	} else if server.Type == "https" {
+		return NewHTTPClient(server, target, true)
 	} else if server.Type == "direct" {
 		return NewDirectClient(server, target)
 	} else {
@@ -43,11 +58,17 @@ type proxyClient struct {
 }
 
 func (h *proxyClient) LocalAddr() net.Addr {
-	return nil
+	if h.Conn == nil {
+		return nil
+	}
+	return h.Conn.LocalAddr()
 }
 
 func (h *proxyClient) RemoteAddr() net.Addr {
-	return nil
+	if h.Conn == nil {
+		return nil
+	}
+	return h.Conn.RemoteAddr()
 }
 
 func (h *proxyClient) SetDeadline(t time.Time) error {
@@ -78,7 +99,8 @@ func (h *proxyClient) LastPing() uint32 {
 	return h.Server.Ping
 }
 
-func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(ProxyClient, uint32, error)) bool {
+// key is the command key of the target server, empty uses nctst.CommandXorKey
+func (hh *proxyClient) Ping(self ProxyClient, key string, printDetails bool, finished func(ProxyClient, uint32, error)) bool {
 	printf := func(format string, a ...any) {
 		if printDetails {
 			fmt.Printf(format, a...)
@@ -86,12 +108,15 @@ func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(P
 	}
 
 	var h = self
+	if key == "" {
+		key = nctst.CommandXorKey
+	}
 	hh.Server.Ping = 100000
 	hh.Server.PingTime = time.Now()
 
 	defer h.Close()
 
-	printf("Connecting %s %s\n", hh.Server.Name, hh.Server.Address())
+	printf("Connecting %s %s\n", hh.Server.Name, hh.Server.Chain())
 	if err := h.Connect(); err != nil {
 		printf("Connect Failed %s %+v\n", hh.Server.Address(), err)
 		if finished != nil {
@@ -113,7 +138,7 @@ func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(P
 
 	printf("SendCommand1 %s\n", hh.Server.Address())
 	cmd := &nctst.CommandTestPing{}
-	if err := nctst.SendCommand(h, &nctst.Command{Type: nctst.Cmd_testping, Item: cmd}); err != nil {
+	if err := nctst.SendCommandWithKey(h, &nctst.Command{Type: nctst.Cmd_testping, Item: cmd}, key); err != nil {
 		printf("SendCommand1 Failed %s %+v\n", hh.Server.Address(), err)
 		if finished != nil {
 			finished(h, 0, err)
@@ -133,7 +158,7 @@ func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(P
 
 	printf("SendCommand2 %s\n", hh.Server.Address())
 	cmd.SendTime = time.Now().UnixNano() / 1e6
-	if err := nctst.SendCommand(h, &nctst.Command{Type: nctst.Cmd_testping, Item: cmd}); err != nil {
+	if err := nctst.SendCommandWithKey(h, &nctst.Command{Type: nctst.Cmd_testping, Item: cmd}, key); err != nil {
 		printf("SendCommand2 Failed %s %+v\n", hh.Server.Address(), err)
 		if finished != nil {
 			finished(h, 0, err)
@@ -151,7 +176,7 @@ func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(P
 		return false
 	}
 
-	command, err := nctst.ReadCommand(buf)
+	command, err := nctst.ReadCommandWithKey(buf, key)
 	if err != nil {
 		printf("ReadCommand Failed %s %+v\n", hh.Server.Address(), err)
 		if finished != nil {
@@ -181,6 +206,65 @@ func (hh *proxyClient) Ping(self ProxyClient, printDetails bool, finished func(P
 	return true
 }
 
+// uploads size/4 and downloads size bytes through a new connection, returns bytes per second
+func (hh *proxyClient) SpeedTest(self ProxyClient, key string, size int) (uint32, error) {
+	var h = self
+	if key == "" {
+		key = nctst.CommandXorKey
+	}
+
+	defer h.Close()
+
+	if err := h.Connect(); err != nil {
+		return 0, err
+	}
+
+	h.SetDeadline(time.Now().Add(time.Second * 20))
+
+	if err := nctst.WriteUInt(h, nctst.NEW_CONNECTION_KEY); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	cmd := &nctst.CommandTestSpeed{Upload: size / 4, Download: size}
+	if err := nctst.SendCommandWithKey(h, &nctst.Command{Type: nctst.Cmd_testspeed, Item: cmd}, key); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, nctst.Min(cmd.Upload, 32*1024))
+	rand.Read(buf)
+	for left := cmd.Upload; left > 0; {
+		n, err := h.Write(buf[:nctst.Min(left, len(buf))])
+		if err != nil {
+			return 0, err
+		}
+		left -= n
+	}
+
+	reply, err := nctst.ReadLBuf(h)
+	if err != nil {
+		return 0, err
+	}
+	command, err := nctst.ReadCommandWithKey(reply, key)
+	reply.Release()
+	if err != nil {
+		return 0, err
+	}
+	if command.Type != nctst.Cmd_testspeed {
+		return 0, errors.New("command type error")
+	}
+	if ret := command.Item.(*nctst.CommandTestSpeed); ret.Upload == 0 && ret.Download == 0 && size > 0 {
+		return 0, ErrSpeedTestBusy
+	}
+
+	if _, err := io.CopyN(io.Discard, h, int64(cmd.Download)); err != nil {
+		return 0, err
+	}
+
+	return uint32(float64(cmd.Upload+cmd.Download) / time.Since(start).Seconds()), nil
+}
+
 func (h *proxyClient) Write(p []byte) (int, error) {
 	if h.Conn == nil {
 		return 0, io.ErrClosedPipe
@@ -2,6 +2,7 @@ package proxyclient
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"os"
@@ -16,15 +17,7 @@ import (
 type ProxyType int
 
 func GetProxyList(proxyFile *ProxyFile, pingTarget *PingTarget, key, userName, password string) (int, []*ProxyInfo, string) {
-	var proxyGroups *ProxyGroups
-	if proxyFile.Type == "net" {
-		proxyGroups = GetProxyListFromNet(proxyFile, key, userName, password)
-	} else if proxyFile.Type == "file" {
-		proxyGroups = GetProxyListFromFile(proxyFile)
-	} else {
-		return 0, nil, ""
-	}
-
+	proxyGroups := GetProxyGroups(proxyFile, key, userName, password)
 	if proxyGroups == nil {
 		return 0, nil, ""
 	}
@@ -32,7 +25,21 @@ func GetProxyList(proxyFile *ProxyFile, pingTarget *PingTarget, key, userName, p
 	return proxyGroups.ClientTotalSelect, SelectProxyFromGroupsInfo(proxyGroups, pingTarget), proxyGroups.Version
 }
 
+func GetProxyGroups(proxyFile *ProxyFile, key, userName, password string) *ProxyGroups {
+	if proxyFile.Type == "net" {
+		return GetProxyListFromNet(proxyFile, key, userName, password)
+	} else if proxyFile.Type == "file" {
+		return GetProxyListFromFile(proxyFile)
+	}
+	return nil
+}
+
 func GetProxyListFromNet(proxyFile *ProxyFile, key, userName, password string) *ProxyGroups {
+	if err := proxyFile.Check(); err != nil {
+		log.Printf("GetProxyListFromNet %s %+v\n", proxyFile.Url, err)
+		return nil
+	}
+
 	log.Printf("**Request proxy list from %s ...", proxyFile.Url)
 
 	req, err := retryablehttp.NewRequest("GET", proxyFile.Url, nil)
@@ -64,10 +71,25 @@ func GetProxyListFromNet(proxyFile *ProxyFile, key, userName, password string) *
 		return nil
 	}
 
-	nctst.Xor(buf.Data()[4:], []byte(key))
-	nctst.Xor(buf.Data()[4:], []byte(userName))
+	if !IsSealedProxyList(buf.Data()) {
+		if proxyFile.PublicKey != "" {
+			log.Printf("GetProxyListFromNet %s %+v\n", proxyFile.Url, ErrProxyListNotSigned)
+			return nil
+		}
+
+		nctst.Xor(buf.Data()[4:], []byte(key))
+		nctst.Xor(buf.Data()[4:], []byte(userName))
 
-	return LoadProxyListFromData(buf.Data(), proxyFile.Password)
+		return LoadProxyListFromData(buf.Data(), proxyFile.Password, proxyFile.PublicKey)
+	}
+
+	data, err := OpenProxyList(buf.Data(), ProxyListSecret(key, nctst.HashPassword(userName, password)))
+	if err != nil {
+		log.Printf("GetProxyListFromNet open %s %+v\n", proxyFile.Url, err)
+		return nil
+	}
+
+	return LoadProxyListFromData(data, proxyFile.Password, proxyFile.PublicKey)
 }
 
 func GetProxyListFromFile(proxyFile *ProxyFile) *ProxyGroups {
@@ -84,12 +106,30 @@ func GetProxyListFromFile(proxyFile *ProxyFile) *ProxyGroups {
 		log.Printf("getProxyListFromFile %+v\n", err)
 		return nil
 	}
-	return LoadProxyListFromData(content, proxyFile.Password)
+	return LoadProxyListFromData(content, proxyFile.Password, proxyFile.PublicKey)
 }
 
-func LoadProxyListFromData(data []byte, password string) *ProxyGroups {
+// a signed list needs publicKey to verify, an unsigned list is refused when publicKey is set
+func LoadProxyListFromData(data []byte, password, publicKey string) *ProxyGroups {
 	nctst.Xor(data, []byte(password))
 
+	key, err := ParseSignPublicKey(publicKey)
+	if err != nil {
+		log.Printf("loadProxyListFromData public key %+v\n", err)
+		return nil
+	}
+
+	signed, err := VerifyProxyList(data, key)
+	if err == nil && len(key) == 0 {
+		err = errors.New("signed proxy list without publickey")
+	}
+	if err == nil {
+		data = signed
+	} else if err != ErrProxyListNotSigned || len(key) > 0 {
+		log.Printf("loadProxyListFromData %+v\n", err)
+		return nil
+	}
+
 	var proxyGroups *ProxyGroups
 	if err := json.Unmarshal(data, &proxyGroups); err != nil {
 		log.Printf("loadProxyListFromData %+v\n", err)
@@ -144,8 +184,7 @@ func PingSelectProxyFromList(input []*ProxyInfo, num int, pingTarget *PingTarget
 	for i := 0; i < pingTarget.PingThreads; i++ {
 		go func() {
 			for work := range workChan {
-				client := NewProxyClient(work, pingTarget.Target)
-				if client.Ping(client, printDetails, nil) {
+				if Probe(work, pingTarget, printDetails) {
 					pingResultChan <- work
 				}
 				waitGroup.Done()
@@ -163,18 +202,19 @@ func PingSelectProxyFromList(input []*ProxyInfo, num int, pingTarget *PingTarget
 	n, total := 1, len(input)
 	for p := range pingResultChan {
 		pingResult = append(pingResult, p)
-		log.Printf("%d/%d %dms %s\n", n, total, p.Ping, p.Name)
+		log.Printf("%d/%d %dms %dKB/s %s\n", n, total, p.Ping, p.Throughput/1024, p.Name)
 		n++
 	}
 	sort.SliceStable(pingResult, func(i, j int) bool {
-		return pingResult[i].Ping < pingResult[j].Ping
+		return pingResult[i].Score < pingResult[j].Score
 	})
 
 	result := make([]*ProxyInfo, 0, len(pingResult))
 	for i, v := range pingResult {
 		result = append(result, v)
 
-		log.Printf("*Ping proxy delay: %s %d\n", v.Address(), v.Ping)
+		log.Printf("*Ping proxy delay: %s %d jitter %d speed %dKB/s success %.0f%% score %.0f\n",
+			v.Address(), v.Ping, v.Jitter, v.Throughput/1024, v.SuccessRate*100, v.Score)
 
 		if i >= num {
 			break
@@ -0,0 +1,146 @@
+package proxyclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	sealedProxyListMagic = []byte("NPL1")
+
+	ErrProxyListNotSigned = errors.New("proxy list not signed")
+	ErrProxyListSignature = errors.New("proxy list signature error")
+)
+
+// the proxy groups json signed by the publisher, the server stores and
+// forwards it unchanged so the clients can verify the publisher
+type SignedProxyList struct {
+	Data      []byte `json:"data"`
+	Signature []byte `json:"sig"`
+}
+
+// the secret of a user is the key and the password hash, both sides know them
+func ProxyListSecret(key, passwordHash string) string {
+	return key + "|" + passwordHash
+}
+
+// aes-256-gcm, magic, nonce then the ciphertext
+func SealProxyList(plain []byte, secret string) ([]byte, error) {
+	aead, err := newProxyListAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(sealedProxyListMagic)+len(nonce)+len(plain)+aead.Overhead())
+	sealed = append(sealed, sealedProxyListMagic...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plain, sealedProxyListMagic), nil
+}
+
+func OpenProxyList(sealed []byte, secret string) ([]byte, error) {
+	if !IsSealedProxyList(sealed) {
+		return nil, errors.New("proxy list not sealed")
+	}
+
+	aead, err := newProxyListAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed = sealed[len(sealedProxyListMagic):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], sealedProxyListMagic)
+}
+
+func IsSealedProxyList(data []byte) bool {
+	return bytes.HasPrefix(data, sealedProxyListMagic)
+}
+
+func newProxyListAEAD(secret string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), nil, []byte("nctst proxylist")), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// returns the json of the SignedProxyList
+func SignProxyList(data []byte, privateKey ed25519.PrivateKey) ([]byte, error) {
+	return json.Marshal(&SignedProxyList{Data: data, Signature: ed25519.Sign(privateKey, data)})
+}
+
+// the signed data, publicKey empty skips the verification for the server
+// without the publisher key, ErrProxyListNotSigned when data is a plain proxy list
+func VerifyProxyList(data []byte, publicKey ed25519.PublicKey) ([]byte, error) {
+	var signed SignedProxyList
+	if err := json.Unmarshal(data, &signed); err != nil || len(signed.Data) == 0 || len(signed.Signature) == 0 {
+		return nil, ErrProxyListNotSigned
+	}
+
+	if len(publicKey) > 0 && !ed25519.Verify(publicKey, signed.Data, signed.Signature) {
+		return nil, ErrProxyListSignature
+	}
+	return signed.Data, nil
+}
+
+// base64 keys, the private key is the 32 bytes seed or the 64 bytes key
+func GenerateSignKey() (string, string, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(privateKey.Seed()), base64.StdEncoding.EncodeToString(publicKey), nil
+}
+
+func ParseSignPrivateKey(s string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("sign private key length error %d", len(key))
+}
+
+func ParseSignPublicKey(s string) (ed25519.PublicKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("sign public key length error %d", len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
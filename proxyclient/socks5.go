@@ -1,6 +1,7 @@
 package proxyclient
 
 import (
+	"net"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -38,6 +39,11 @@ func (h *Socks5Client) Connect() error {
 		HandshakeTimeout: time.Second * 5,
 		Auth:             auth,
 	}
+	if h.Server.Via != nil {
+		client.Dialer = func(*socks5.Client, *socks5.Request) (net.Conn, error) {
+			return dialServer(h.Server, client.DialTimeout)
+		}
+	}
 
 	conn, err := client.Connect(socks5.Version5, h.Target.Address())
 	if err != nil {
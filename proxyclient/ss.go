@@ -0,0 +1,363 @@
+package proxyclient
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"strings"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/sun8911879/shadowsocksR/tools/socks"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+const (
+	ssMaxChunk     = 0x3FFF
+	ss2022MaxChunk = 0xFFFF
+	ss2022MaxDrift = 30
+)
+
+type ssMethod struct {
+	keySize int
+	is2022  bool
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var ssMethods = map[string]*ssMethod{
+	"aes-128-gcm":                   {16, false, newGCM},
+	"aes-192-gcm":                   {24, false, newGCM},
+	"aes-256-gcm":                   {32, false, newGCM},
+	"chacha20-ietf-poly1305":        {32, false, chacha20poly1305.New},
+	"chacha20-poly1305":             {32, false, chacha20poly1305.New},
+	"2022-blake3-aes-128-gcm":       {16, true, newGCM},
+	"2022-blake3-aes-256-gcm":       {32, true, newGCM},
+	"2022-blake3-chacha20-poly1305": {32, true, chacha20poly1305.New},
+}
+
+// one direction of the stream, the nonce is a little endian counter
+type ssAEAD struct {
+	cipher.AEAD
+	nonce []byte
+}
+
+func (h *ssAEAD) seal(dst, plain []byte) []byte {
+	dst = h.Seal(dst, h.nonce, plain, nil)
+	h.increase()
+	return dst
+}
+
+func (h *ssAEAD) open(data []byte) ([]byte, error) {
+	plain, err := h.Open(data[:0], h.nonce, data, nil)
+	h.increase()
+	return plain, err
+}
+
+func (h *ssAEAD) increase() {
+	for i := range h.nonce {
+		h.nonce[i]++
+		if h.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// shadowsocks AEAD (SIP004) and shadowsocks 2022 (SIP022) with a single psk,
+// params: cipher
+type SSClient struct {
+	proxyClient
+
+	Cipher string
+
+	method      *ssMethod
+	key         []byte
+	keyErr      error
+	writer      *ssAEAD
+	reader      *ssAEAD
+	requestSalt []byte
+	readBuf     []byte
+}
+
+func NewSSClient(server *ProxyInfo, target *nctst.AddrInfo) ProxyClient {
+	h := &SSClient{}
+	h.Server = server
+	h.Target = target
+	h.Cipher = strings.ToLower(server.Params["cipher"])
+
+	h.method = ssMethods[h.Cipher]
+	if h.method == nil {
+		h.keyErr = fmt.Errorf("ss unsupported cipher %s", h.Cipher)
+	} else if h.method.is2022 {
+		h.key, h.keyErr = ss2022Key(server.Password, h.method.keySize)
+	} else {
+		h.key = ssKDF(server.Password, h.method.keySize)
+	}
+
+	return h
+}
+
+func (h *SSClient) Connect() error {
+	h.Close()
+	h.writer = nil
+	h.reader = nil
+	h.requestSalt = nil
+	h.readBuf = nil
+
+	if h.keyErr != nil {
+		return h.keyErr
+	}
+
+	conn, err := dialServer(h.Server, time.Second*2)
+	if err != nil {
+		return err
+	}
+
+	h.Conn = conn
+	return nil
+}
+
+func (h *SSClient) Write(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	var buf []byte
+	if h.writer == nil {
+		var err error
+		if buf, err = h.header(p); err != nil {
+			return 0, err
+		}
+	} else {
+		buf = h.appendChunks(nil, p)
+	}
+
+	if _, err := h.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// the salt and the target address are sent with the first payload
+func (h *SSClient) header(p []byte) ([]byte, error) {
+	salt := make([]byte, h.method.keySize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	aead, err := h.newAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	h.writer = aead
+	h.requestSalt = salt
+
+	addr := socks.ParseAddr(h.Target.Address())
+	if addr == nil {
+		return nil, fmt.Errorf("ss error target %s", h.Target.Address())
+	}
+
+	buf := make([]byte, 0, len(salt)+len(addr)+len(p)+1024)
+	buf = append(buf, salt...)
+
+	if !h.method.is2022 {
+		return h.appendChunks(buf, append(addr, p...)), nil
+	}
+
+	// request header: fixed length header then the variable length header
+	// with the address, padding and the initial payload
+	payload := p
+	if max := ss2022MaxChunk - len(addr) - 2; len(payload) > max {
+		payload = payload[:max]
+	}
+
+	var padding int
+	if len(payload) == 0 {
+		padding = 1 + mrand.Intn(900)
+	}
+
+	variable := make([]byte, 0, len(addr)+2+padding+len(payload))
+	variable = append(variable, addr...)
+	variable = binary.BigEndian.AppendUint16(variable, uint16(padding))
+	variable = append(variable, make([]byte, padding)...)
+	variable = append(variable, payload...)
+
+	fixed := make([]byte, 0, 11)
+	fixed = append(fixed, 0)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(variable)))
+
+	buf = h.writer.seal(buf, fixed)
+	buf = h.writer.seal(buf, variable)
+	return h.appendChunks(buf, p[len(payload):]), nil
+}
+
+func (h *SSClient) appendChunks(buf []byte, data []byte) []byte {
+	max := ssMaxChunk
+	if h.method.is2022 {
+		max = ss2022MaxChunk
+	}
+
+	for len(data) > 0 {
+		n := nctst.Min(len(data), max)
+		buf = h.writer.seal(buf, binary.BigEndian.AppendUint16(nil, uint16(n)))
+		buf = h.writer.seal(buf, data[:n])
+		data = data[n:]
+	}
+	return buf
+}
+
+func (h *SSClient) Read(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	for len(h.readBuf) == 0 {
+		if err := h.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, h.readBuf)
+	h.readBuf = h.readBuf[n:]
+	return n, nil
+}
+
+func (h *SSClient) readChunk() error {
+	if h.reader == nil {
+		if h.writer == nil {
+			return errors.New("ss read before request")
+		}
+
+		salt := make([]byte, h.method.keySize)
+		if _, err := io.ReadFull(h.Conn, salt); err != nil {
+			return err
+		}
+
+		aead, err := h.newAEAD(salt)
+		if err != nil {
+			return err
+		}
+		h.reader = aead
+
+		if h.method.is2022 {
+			return h.readResponseHeader()
+		}
+	}
+
+	buf := make([]byte, 2+h.reader.Overhead())
+	if _, err := io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+	l, err := h.reader.open(buf)
+	if err != nil {
+		return err
+	}
+
+	n := int(binary.BigEndian.Uint16(l))
+	if !h.method.is2022 {
+		n &= ssMaxChunk
+	}
+	return h.readPayload(n)
+}
+
+// type, timestamp, request salt and the length of the first chunk
+func (h *SSClient) readResponseHeader() error {
+	buf := make([]byte, 1+8+h.method.keySize+2+h.reader.Overhead())
+	if _, err := io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+	fixed, err := h.reader.open(buf)
+	if err != nil {
+		return err
+	}
+
+	if fixed[0] != 1 {
+		return errors.New("ss2022 response type error")
+	}
+	if drift := time.Now().Unix() - int64(binary.BigEndian.Uint64(fixed[1:9])); drift > ss2022MaxDrift || drift < -ss2022MaxDrift {
+		return errors.New("ss2022 response time error")
+	}
+	if !bytes.Equal(fixed[9:9+h.method.keySize], h.requestSalt) {
+		return errors.New("ss2022 response salt error")
+	}
+
+	return h.readPayload(int(binary.BigEndian.Uint16(fixed[9+h.method.keySize:])))
+}
+
+func (h *SSClient) readPayload(n int) error {
+	buf := make([]byte, n+h.reader.Overhead())
+	if _, err := io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+	payload, err := h.reader.open(buf)
+	if err != nil {
+		return err
+	}
+	h.readBuf = payload
+	return nil
+}
+
+func (h *SSClient) newAEAD(salt []byte) (*ssAEAD, error) {
+	subkey := make([]byte, h.method.keySize)
+	if h.method.is2022 {
+		blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(append([]byte{}, h.key...), salt...))
+	} else if _, err := io.ReadFull(hkdf.New(sha1.New, h.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+
+	aead, err := h.method.newAEAD(subkey)
+	if err != nil {
+		return nil, err
+	}
+	return &ssAEAD{AEAD: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+// EVP_BytesToKey with md5
+func ssKDF(password string, keySize int) []byte {
+	var key, prev []byte
+	hash := md5.New()
+	for len(key) < keySize {
+		hash.Write(prev)
+		hash.Write([]byte(password))
+		key = hash.Sum(key)
+		prev = key[len(key)-hash.Size():]
+		hash.Reset()
+	}
+	return key[:keySize]
+}
+
+// the password of shadowsocks 2022 is the base64 psk, multiple psks (identity
+// headers) are not supported
+func ss2022Key(password string, keySize int) ([]byte, error) {
+	if strings.Contains(password, ":") {
+		return nil, errors.New("ss2022 multiple psks not supported")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("ss2022 psk error: %+v", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("ss2022 psk length %d, need %d", len(key), keySize)
+	}
+	return key, nil
+}
@@ -2,9 +2,13 @@ package proxyclient
 
 import (
 	"net/url"
+	"time"
 
 	"github.com/PIngBZ/nctst"
 	shadowsocksr "github.com/sun8911879/shadowsocksR"
+	"github.com/sun8911879/shadowsocksR/obfs"
+	"github.com/sun8911879/shadowsocksR/protocol"
+	"github.com/sun8911879/shadowsocksR/ssr"
 	"github.com/sun8911879/shadowsocksR/tools/socks"
 )
 
@@ -60,7 +64,13 @@ func (h *SSRClient) Connect() error {
 	v.Set("protocol-param", h.ProtocolParam)
 	u.RawQuery = v.Encode()
 
-	ssrconn, err := shadowsocksr.NewSSRClient(u)
+	var ssrconn *shadowsocksr.SSTCPConn
+	var err error
+	if h.Server.Via == nil {
+		ssrconn, err = shadowsocksr.NewSSRClient(u)
+	} else {
+		ssrconn, err = h.dialVia()
+	}
 	if err != nil {
 		return err
 	}
@@ -77,3 +87,35 @@ func (h *SSRClient) Connect() error {
 	h.Conn = ssrconn
 	return nil
 }
+
+// same as shadowsocksr.NewSSRClient over the via chain, which dials by itself
+func (h *SSRClient) dialVia() (*shadowsocksr.SSTCPConn, error) {
+	cipher, err := shadowsocksr.NewStreamCipher(h.EncryptMethod, h.Server.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialServer(h.Server, time.Second*2)
+	if err != nil {
+		return nil, err
+	}
+
+	ssrconn := shadowsocksr.NewSSTCPConn(conn, cipher)
+
+	ssrconn.IObfs = obfs.NewObfs(h.Obfs)
+	ssrconn.IObfs.SetServerInfo(&ssr.ServerInfoForObfs{
+		Host:   h.Server.Host,
+		Port:   uint16(h.Server.Port),
+		TcpMss: 1460,
+		Param:  h.ObfsParam,
+	})
+	ssrconn.IProtocol = protocol.NewProtocol(h.Protocol)
+	ssrconn.IProtocol.SetServerInfo(&ssr.ServerInfoForObfs{
+		Host:   h.Server.Host,
+		Port:   uint16(h.Server.Port),
+		TcpMss: 1460,
+		Param:  h.ProtocolParam,
+	})
+
+	return ssrconn, nil
+}
@@ -0,0 +1,167 @@
+package proxyclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tls params shared by the proxy types:
+// sni: server name, defaults to defaultSNI then the proxy host,
+// alpn: comma separated protocols,
+// insecure: true to skip the certificate verification,
+// pin: sha256 of the server certificate (hex, colons allowed, or base64), the
+// chain is not verified when the pin matches, for self signed certificates,
+// fingerprint: the client hello of chrome, firefox, safari, ios, edge or random
+// through utls, empty or go for the go tls handshake
+func newTLSConfig(server *ProxyInfo, defaultSNI string) (*tls.Config, error) {
+	params := server.Params
+
+	if fingerprint := params["fingerprint"]; fingerprint != "" && fingerprint != "go" {
+		if _, ok := tlsFingerprints[fingerprint]; !ok {
+			return nil, fmt.Errorf("tls fingerprint %s not supported", fingerprint)
+		}
+	}
+
+	conf := &tls.Config{
+		ServerName:         params["sni"],
+		InsecureSkipVerify: params["insecure"] == "true",
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = defaultSNI
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = server.Host
+	}
+
+	if alpn := params["alpn"]; alpn != "" {
+		for _, proto := range strings.Split(alpn, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				conf.NextProtos = append(conf.NextProtos, proto)
+			}
+		}
+	}
+
+	if pin := params["pin"]; pin != "" {
+		sum, err := parsePin(pin)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("tls no peer certificate")
+			}
+			cert := sha256.Sum256(state.PeerCertificates[0].Raw)
+			if !bytes.Equal(cert[:], sum) {
+				return fmt.Errorf("tls certificate pin mismatch %s", hex.EncodeToString(cert[:]))
+			}
+			return nil
+		}
+	}
+
+	return conf, nil
+}
+
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+	"ios":     utls.HelloIOS_Auto,
+	"edge":    utls.HelloEdge_Auto,
+	"random":  utls.HelloRandomizedALPN,
+}
+
+type tlsConn interface {
+	net.Conn
+	Handshake() error
+}
+
+// the tls handshake over raw, with the browser client hello of the fingerprint param
+func handshakeTLS(server *ProxyInfo, raw net.Conn, conf *tls.Config) (net.Conn, error) {
+	var conn tlsConn
+	if id, ok := tlsFingerprints[server.Params["fingerprint"]]; ok {
+		uconn, err := newUTLSClient(raw, conf, id)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		conn = uconn
+	} else {
+		conn = tls.Client(raw, conf)
+	}
+
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// the alpn of the browser is replaced when conf has one, the pin check
+// only needs the peer certificates
+func newUTLSClient(raw net.Conn, conf *tls.Config, id utls.ClientHelloID) (*utls.UConn, error) {
+	uconf := &utls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+		NextProtos:         conf.NextProtos,
+	}
+	if verify := conf.VerifyConnection; verify != nil {
+		uconf.VerifyConnection = func(state utls.ConnectionState) error {
+			return verify(tls.ConnectionState{PeerCertificates: state.PeerCertificates})
+		}
+	}
+
+	if id == utls.HelloRandomizedALPN {
+		return utls.UClient(raw, uconf, id), nil
+	}
+
+	spec, err := utls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.NextProtos) > 0 {
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*utls.ALPNExtension); ok {
+				alpn.AlpnProtocols = conf.NextProtos
+			}
+		}
+	}
+
+	uconn := utls.UClient(raw, uconf, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// http over tls can not follow the h2 of a browser client hello
+func httpOverTLS(conf *tls.Config) *tls.Config {
+	if len(conf.NextProtos) == 0 {
+		conf.NextProtos = []string{"http/1.1"}
+	}
+	return conf
+}
+
+func parsePin(pin string) ([]byte, error) {
+	if sum, err := hex.DecodeString(strings.ReplaceAll(pin, ":", "")); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	if sum, err := base64.StdEncoding.DecodeString(pin); err == nil && len(sum) == sha256.Size {
+		return sum, nil
+	}
+	return nil, fmt.Errorf("tls pin error %s", pin)
+}
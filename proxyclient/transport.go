@@ -0,0 +1,117 @@
+package proxyclient
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport params shared by vmess and vless:
+// network: tcp (default) or ws, path and host: websocket path and Host header,
+// tls: true to wrap with tls, the tls params see newTLSConfig
+func dialTransport(server *ProxyInfo) (net.Conn, error) {
+	params := server.Params
+
+	var tlsConfig *tls.Config
+	if params["tls"] == "true" || params["tls"] == "tls" {
+		var err error
+		if tlsConfig, err = newTLSConfig(server, params["host"]); err != nil {
+			return nil, err
+		}
+	}
+
+	if params["network"] == "ws" {
+		if tlsConfig != nil {
+			tlsConfig = httpOverTLS(tlsConfig)
+		}
+		return dialWebsocket(server, tlsConfig)
+	}
+
+	if tlsConfig != nil {
+		return dialTLS(server, tlsConfig)
+	}
+	return dialServer(server, time.Second*2)
+}
+
+func dialWebsocket(server *ProxyInfo, tlsConfig *tls.Config) (net.Conn, error) {
+	u := &url.URL{Scheme: "ws", Host: server.Address(), Path: server.Params["path"]}
+	if tlsConfig != nil {
+		u.Scheme = "wss"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	header := http.Header{}
+	if host := server.Params["host"]; host != "" {
+		header.Set("Host", host)
+	}
+
+	wsDialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialServer(server, time.Second*2)
+		},
+		HandshakeTimeout: time.Second * 5,
+	}
+	if tlsConfig != nil {
+		wsDialer.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTLS(server, tlsConfig)
+		}
+	}
+
+	conn, response, err := wsDialer.Dial(u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	return &wsConn{Conn: conn}, nil
+}
+
+// binary websocket messages as a stream
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (h *wsConn) Read(p []byte) (int, error) {
+	for {
+		if h.reader == nil {
+			_, reader, err := h.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			h.reader = reader
+		}
+
+		n, err := h.reader.Read(p)
+		if err == io.EOF {
+			h.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (h *wsConn) Write(p []byte) (int, error) {
+	if err := h.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *wsConn) SetDeadline(t time.Time) error {
+	if err := h.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return h.SetWriteDeadline(t)
+}
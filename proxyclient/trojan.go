@@ -3,12 +3,9 @@ package proxyclient
 import (
 	"bytes"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
-	"time"
 
 	"github.com/PIngBZ/nctst"
 )
@@ -31,13 +28,14 @@ func (h *TrojanClient) Connect() error {
 	h.Close()
 	h.headerWritten = false
 
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         h.Server.LoginName,
+	// legacy: loginname was the sni before params, still used when the sni param
+	// is empty so the old lists keep working, new lists should set params sni
+	conf, err := newTLSConfig(h.Server, h.Server.LoginName)
+	if err != nil {
+		return err
 	}
 
-	dialer := &net.Dialer{Timeout: time.Second * 2}
-	conn, err := tls.DialWithDialer(dialer, "tcp", h.Server.Address(), conf)
+	conn, err := dialTLS(h.Server, conf)
 	if err != nil {
 		return err
 	}
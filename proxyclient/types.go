@@ -1,6 +1,7 @@
 package proxyclient
 
 import (
+	"errors"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -11,6 +12,20 @@ type ProxyFile struct {
 	Url      string `json:"url"`
 	Key      string `json:"key"`
 	Password string `json:"password"`
+	// base64 ed25519 public key of the publisher, signed lists are only used
+	// when verified, required for net lists
+	PublicKey string `json:"publickey"`
+	// legacy: accepts the unsigned xor lists of the old servers without publickey
+	AllowUnsigned bool `json:"allowunsigned"`
+}
+
+// a net list is only used with the publisher key unless unsigned lists are allowed
+func (h *ProxyFile) Check() error {
+	if h.Type == "net" && h.Url != "" && h.PublicKey == "" && !h.AllowUnsigned {
+		return errors.New("proxyfile publickey is required for net proxy list")
+	}
+	_, err := ParseSignPublicKey(h.PublicKey)
+	return err
 }
 
 type ProxyInfo struct {
@@ -21,8 +36,15 @@ type ProxyInfo struct {
 	Password  string            `json:"password"`
 	ConnNum   int               `json:"connnum"`
 	Params    map[string]string `json:"params"`
-	Ping      uint32            `json:"-"`
-	PingTime  time.Time         `json:"-"`
+	// the proxy server is dialed through this proxy, which may have its own via
+	Via      *ProxyInfo `json:"via,omitempty"`
+	Ping     uint32     `json:"-"`
+	PingTime time.Time  `json:"-"`
+	// set by Probe
+	Jitter      uint32  `json:"-"`
+	Throughput  uint32  `json:"-"`
+	SuccessRate float32 `json:"-"`
+	Score       float32 `json:"-"`
 }
 
 type ProxyGroup struct {
@@ -38,6 +60,12 @@ type ProxyGroups struct {
 }
 
 type PingTarget struct {
-	Target      *nctst.AddrInfo
+	Target *nctst.AddrInfo
+	// command key of the target server, empty uses nctst.CommandXorKey
+	Key         string
 	PingThreads int
+	// pings per proxy, default 3
+	PingSamples int
+	// bytes downloaded by the speed test, default 256KB, at most 2MB, negative to disable
+	SpeedTestSize int
 }
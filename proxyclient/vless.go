@@ -0,0 +1,113 @@
+package proxyclient
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/google/uuid"
+)
+
+// password is the user id, flows like xtls-rprx-vision are not supported,
+// transport params see dialTransport
+type VLESSClient struct {
+	proxyClient
+
+	id     uuid.UUID
+	idErr  error
+	header bool
+	reply  bool
+}
+
+func NewVLESSClient(server *ProxyInfo, target *nctst.AddrInfo) ProxyClient {
+	h := &VLESSClient{}
+	h.Server = server
+	h.Target = target
+
+	h.id, h.idErr = uuid.Parse(server.Password)
+	if flow := server.Params["flow"]; flow != "" && h.idErr == nil {
+		h.idErr = fmt.Errorf("vless unsupported flow %s", flow)
+	}
+	return h
+}
+
+func (h *VLESSClient) Connect() error {
+	h.Close()
+	h.header = false
+	h.reply = false
+
+	if h.idErr != nil {
+		return h.idErr
+	}
+
+	conn, err := dialTransport(h.Server)
+	if err != nil {
+		return err
+	}
+
+	h.Conn = conn
+	return nil
+}
+
+func (h *VLESSClient) Write(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	if h.header {
+		return h.Conn.Write(p)
+	}
+
+	// version, id, addons length, command tcp, port and address
+	buf := make([]byte, 0, 1+16+1+1+2+1+256+len(p))
+	buf = append(buf, 0)
+	buf = append(buf, h.id[:]...)
+	buf = append(buf, 0, 1)
+	buf = appendPortAddr(buf, h.Target)
+	buf = append(buf, p...)
+
+	if _, err := h.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	h.header = true
+	return len(p), nil
+}
+
+func (h *VLESSClient) Read(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	// version and addons
+	if !h.reply {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(h.Conn, head); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, h.Conn, int64(head[1])); err != nil {
+			return 0, err
+		}
+		h.reply = true
+	}
+
+	return h.Conn.Read(p)
+}
+
+// port then the address type (1 ipv4, 2 domain, 3 ipv6) and address, used by vless and vmess
+func appendPortAddr(buf []byte, target *nctst.AddrInfo) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(target.Port))
+
+	if ip := net.ParseIP(target.Host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, 1)
+			return append(buf, ip4...)
+		}
+		buf = append(buf, 3)
+		return append(buf, ip.To16()...)
+	}
+
+	buf = append(buf, 2, byte(len(target.Host)))
+	return append(buf, target.Host...)
+}
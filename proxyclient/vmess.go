@@ -0,0 +1,335 @@
+package proxyclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	mrand "math/rand"
+	"strings"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	vmessMaxChunk = 16*1024 - 16
+
+	vmessSecurityAES128GCM        = 3
+	vmessSecurityChacha20Poly1305 = 4
+)
+
+// vmess with aead header (alterId 0), password is the user id,
+// params: security aes-128-gcm (auto) or chacha20-poly1305, transport params see dialTransport
+type VMessClient struct {
+	proxyClient
+
+	Security string
+
+	security    byte
+	cmdKey      []byte
+	keyErr      error
+	responseKey []byte
+	responseIV  []byte
+	auth        byte
+	writer      *vmessBody
+	reader      *vmessBody
+	readBuf     []byte
+}
+
+// chunk cipher, the nonce is the chunk count followed by iv[2:12]
+type vmessBody struct {
+	cipher.AEAD
+	iv    []byte
+	count uint16
+}
+
+func (h *vmessBody) nonce() []byte {
+	nonce := make([]byte, h.NonceSize())
+	binary.BigEndian.PutUint16(nonce, h.count)
+	copy(nonce[2:], h.iv[2:12])
+	h.count++
+	return nonce
+}
+
+func NewVMessClient(server *ProxyInfo, target *nctst.AddrInfo) ProxyClient {
+	h := &VMessClient{}
+	h.Server = server
+	h.Target = target
+	h.Security = strings.ToLower(server.Params["security"])
+
+	switch h.Security {
+	case "", "auto", "aes-128-gcm":
+		h.security = vmessSecurityAES128GCM
+	case "chacha20-poly1305":
+		h.security = vmessSecurityChacha20Poly1305
+	default:
+		h.keyErr = fmt.Errorf("vmess unsupported security %s", h.Security)
+	}
+
+	id, err := uuid.Parse(server.Password)
+	if err != nil {
+		h.keyErr = err
+	} else {
+		sum := md5.Sum(append(id[:], []byte("c48619fe-8f02-49e0-b9e9-edf763e17e21")...))
+		h.cmdKey = sum[:]
+	}
+	return h
+}
+
+func (h *VMessClient) Connect() error {
+	h.Close()
+	h.writer = nil
+	h.reader = nil
+	h.readBuf = nil
+
+	if h.keyErr != nil {
+		return h.keyErr
+	}
+
+	conn, err := dialTransport(h.Server)
+	if err != nil {
+		return err
+	}
+
+	h.Conn = conn
+	return nil
+}
+
+func (h *VMessClient) Write(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	var buf []byte
+	if h.writer == nil {
+		var err error
+		if buf, err = h.header(); err != nil {
+			return 0, err
+		}
+	}
+	buf = h.appendChunks(buf, p)
+
+	if _, err := h.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (h *VMessClient) header() ([]byte, error) {
+	keyIV := make([]byte, 33)
+	if _, err := rand.Read(keyIV); err != nil {
+		return nil, err
+	}
+	requestKey, requestIV, auth := keyIV[:16], keyIV[16:32], keyIV[32]
+
+	responseKey := sha256.Sum256(requestKey)
+	responseIV := sha256.Sum256(requestIV)
+	h.responseKey = responseKey[:16]
+	h.responseIV = responseIV[:16]
+	h.auth = auth
+
+	writer, err := newVMessBody(h.security, requestKey, requestIV)
+	if err != nil {
+		return nil, err
+	}
+	h.writer = writer
+
+	// version, iv, key, auth, option chunk stream, padding and security,
+	// reserved, command tcp, port and address, padding, fnv1a
+	padding := mrand.Intn(16)
+	header := make([]byte, 0, 128)
+	header = append(header, 1)
+	header = append(header, requestIV...)
+	header = append(header, requestKey...)
+	header = append(header, auth, 1, byte(padding<<4)|h.security, 0, 1)
+	header = appendPortAddr(header, h.Target)
+	paddingData := make([]byte, padding)
+	rand.Read(paddingData)
+	header = append(header, paddingData...)
+
+	fnv1a := fnv.New32a()
+	fnv1a.Write(header)
+	header = fnv1a.Sum(header)
+
+	return sealVMessHeader(h.cmdKey, header)
+}
+
+func (h *VMessClient) appendChunks(buf []byte, data []byte) []byte {
+	for len(data) > 0 {
+		n := nctst.Min(len(data), vmessMaxChunk)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n+h.writer.Overhead()))
+		buf = h.writer.Seal(buf, h.writer.nonce(), data[:n], nil)
+		data = data[n:]
+	}
+	return buf
+}
+
+func (h *VMessClient) Read(p []byte) (int, error) {
+	if h.Conn == nil {
+		return 0, io.ErrClosedPipe
+	}
+
+	for len(h.readBuf) == 0 {
+		if err := h.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, h.readBuf)
+	h.readBuf = h.readBuf[n:]
+	return n, nil
+}
+
+func (h *VMessClient) readChunk() error {
+	if h.reader == nil {
+		if h.writer == nil {
+			return errors.New("vmess read before request")
+		}
+		if err := h.readResponseHeader(); err != nil {
+			return err
+		}
+
+		reader, err := newVMessBody(h.security, h.responseKey, h.responseIV)
+		if err != nil {
+			return err
+		}
+		h.reader = reader
+	}
+
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(h.Conn, l); err != nil {
+		return err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+
+	payload, err := h.reader.Open(buf[:0], h.reader.nonce(), buf, nil)
+	if err != nil {
+		return err
+	}
+	// an empty chunk ends the stream
+	if len(payload) == 0 {
+		return io.EOF
+	}
+	h.readBuf = payload
+	return nil
+}
+
+func (h *VMessClient) readResponseHeader() error {
+	lengthAEAD, err := newGCM(vmessKDF(h.responseKey, "AEAD Resp Header Len Key")[:16])
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2+lengthAEAD.Overhead())
+	if _, err = io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+	l, err := lengthAEAD.Open(buf[:0], vmessKDF(h.responseIV, "AEAD Resp Header Len IV")[:12], buf, nil)
+	if err != nil {
+		return err
+	}
+
+	payloadAEAD, err := newGCM(vmessKDF(h.responseKey, "AEAD Resp Header Key")[:16])
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, int(binary.BigEndian.Uint16(l))+payloadAEAD.Overhead())
+	if _, err = io.ReadFull(h.Conn, buf); err != nil {
+		return err
+	}
+	header, err := payloadAEAD.Open(buf[:0], vmessKDF(h.responseIV, "AEAD Resp Header IV")[:12], buf, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(header) < 4 || header[0] != h.auth {
+		return errors.New("vmess response auth error")
+	}
+	return nil
+}
+
+func newVMessBody(security byte, key, iv []byte) (*vmessBody, error) {
+	var aead cipher.AEAD
+	var err error
+	if security == vmessSecurityChacha20Poly1305 {
+		k1 := md5.Sum(key)
+		k2 := md5.Sum(k1[:])
+		aead, err = chacha20poly1305.New(append(k1[:], k2[:]...))
+	} else {
+		aead, err = newGCM(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &vmessBody{AEAD: aead, iv: iv}, nil
+}
+
+// auth id, encrypted length, connection nonce, encrypted header
+func sealVMessHeader(cmdKey []byte, header []byte) ([]byte, error) {
+	authID := make([]byte, 16)
+	binary.BigEndian.PutUint64(authID, uint64(time.Now().Unix()))
+	if _, err := rand.Read(authID[8:12]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(authID[12:], crc32.ChecksumIEEE(authID[:12]))
+
+	block, err := aes.NewCipher(vmessKDF(cmdKey, "AES Auth ID Encryption")[:16])
+	if err != nil {
+		return nil, err
+	}
+	block.Encrypt(authID, authID)
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	lengthAEAD, err := newGCM(vmessKDF(cmdKey, "VMess Header AEAD Key_Length", string(authID), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+	payloadAEAD, err := newGCM(vmessKDF(cmdKey, "VMess Header AEAD Key", string(authID), string(nonce))[:16])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, 16+2+16+8+len(header)+16)
+	buf = append(buf, authID...)
+	buf = lengthAEAD.Seal(buf, vmessKDF(cmdKey, "VMess Header AEAD Nonce_Length", string(authID), string(nonce))[:12],
+		binary.BigEndian.AppendUint16(nil, uint16(len(header))), authID)
+	buf = append(buf, nonce...)
+	buf = payloadAEAD.Seal(buf, vmessKDF(cmdKey, "VMess Header AEAD Nonce", string(authID), string(nonce))[:12],
+		header, authID)
+	return buf, nil
+}
+
+// nested hmac-sha256 keyed by "VMess AEAD KDF" then every path element
+func vmessKDF(key []byte, path ...string) []byte {
+	creator := func() hash.Hash {
+		return hmac.New(sha256.New, []byte("VMess AEAD KDF"))
+	}
+	for _, p := range path {
+		parent, value := creator, []byte(p)
+		creator = func() hash.Hash {
+			return hmac.New(parent, value)
+		}
+	}
+
+	mac := creator()
+	mac.Write(key)
+	return mac.Sum(nil)
+}
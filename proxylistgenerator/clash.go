@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/PIngBZ/nctst/proxyclient"
+	"gopkg.in/yaml.v3"
+)
+
+type clashConfig struct {
+	Proxies []clashProxy `yaml:"proxies"`
+}
+
+type clashProxy map[string]any
+
+func (h clashProxy) String(key string) string {
+	switch v := h[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (h clashProxy) Bool(key string) bool {
+	switch v := h[key].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// yaml decodes the nested maps as clashProxy too
+func (h clashProxy) Map(key string) clashProxy {
+	switch v := h[key].(type) {
+	case clashProxy:
+		return v
+	case map[string]any:
+		return v
+	}
+	return clashProxy{}
+}
+
+// alpn is a list in clash
+func (h clashProxy) List(key string) string {
+	if v, ok := h[key].([]any); ok {
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return h.String(key)
+}
+
+func parseClash(data []byte) ([]*proxyclient.ProxyInfo, bool) {
+	var config clashConfig
+	if err := yaml.Unmarshal(data, &config); err != nil || len(config.Proxies) == 0 {
+		return nil, false
+	}
+
+	proxies := make([]*proxyclient.ProxyInfo, 0, len(config.Proxies))
+	for _, item := range config.Proxies {
+		proxy, err := clashToProxyInfo(item)
+		if err != nil {
+			log.Printf("parseClash skip %s %+v\n", item.String("name"), err)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, true
+}
+
+func clashToProxyInfo(item clashProxy) (*proxyclient.ProxyInfo, error) {
+	port, err := strconv.Atoi(item.String("port"))
+	if err != nil {
+		return nil, fmt.Errorf("port error %s", item.String("port"))
+	}
+
+	proxy := &proxyclient.ProxyInfo{
+		AddrInfo: nctst.AddrInfo{Host: item.String("server"), Port: port},
+		Name:     item.String("name"),
+		Type:     item.String("type"),
+		Params:   make(map[string]string),
+	}
+
+	switch proxy.Type {
+	case "ss":
+		if plugin := item.String("plugin"); plugin != "" {
+			return nil, fmt.Errorf("ss plugin %s not supported", plugin)
+		}
+		proxy.Password = item.String("password")
+		proxy.Params["cipher"] = item.String("cipher")
+
+	case "ssr":
+		proxy.Password = item.String("password")
+		proxy.Params["cipher"] = item.String("cipher")
+		proxy.Params["obfs"] = item.String("obfs")
+		proxy.Params["obfs-param"] = item.String("obfs-param")
+		proxy.Params["protocol"] = item.String("protocol")
+		proxy.Params["protocol-param"] = item.String("protocol-param")
+
+	case "trojan":
+		if network := item.String("network"); network != "" && network != "tcp" {
+			return nil, fmt.Errorf("trojan network %s not supported", network)
+		}
+		proxy.Password = item.String("password")
+		setTLSParams(proxy, item.String("sni"), item.List("alpn"), item.Bool("skip-cert-verify"))
+
+	case "vmess", "vless":
+		if proxy.Type == "vmess" && item.String("alterId") != "" && item.String("alterId") != "0" {
+			return nil, fmt.Errorf("vmess alterId %s not supported", item.String("alterId"))
+		}
+		if flow := item.String("flow"); flow != "" {
+			return nil, fmt.Errorf("vless flow %s not supported", flow)
+		}
+		if _, ok := item["reality-opts"]; ok {
+			return nil, fmt.Errorf("reality not supported")
+		}
+
+		proxy.Password = item.String("uuid")
+		if proxy.Type == "vmess" {
+			if err := setVMessSecurity(proxy, item.String("cipher")); err != nil {
+				return nil, err
+			}
+		}
+
+		network := item.String("network")
+		switch network {
+		case "", "tcp":
+		case "ws":
+			opts := item.Map("ws-opts")
+			proxy.Params["network"] = "ws"
+			proxy.Params["path"] = opts.String("path")
+			proxy.Params["host"] = opts.Map("headers").String("Host")
+			if path := item.String("ws-path"); path != "" {
+				proxy.Params["path"] = path
+			}
+		default:
+			return nil, fmt.Errorf("%s network %s not supported", proxy.Type, network)
+		}
+
+		if item.Bool("tls") {
+			proxy.Params["tls"] = "true"
+			setTLSParams(proxy, item.String("servername"), item.List("alpn"), item.Bool("skip-cert-verify"))
+		}
+
+	case "http", "socks5":
+		proxy.LoginName = item.String("username")
+		proxy.Password = item.String("password")
+		if item.Bool("tls") {
+			if proxy.Type == "socks5" {
+				return nil, fmt.Errorf("socks5 tls not supported")
+			}
+			proxy.Type = "https"
+			setTLSParams(proxy, item.String("sni"), "", item.Bool("skip-cert-verify"))
+		}
+
+	default:
+		return nil, fmt.Errorf("type %s not supported", proxy.Type)
+	}
+
+	return proxy, nil
+}
+
+func setTLSParams(proxy *proxyclient.ProxyInfo, sni, alpn string, insecure bool) {
+	if sni != "" {
+		proxy.Params["sni"] = sni
+	}
+	if alpn != "" {
+		proxy.Params["alpn"] = alpn
+	}
+	if insecure {
+		proxy.Params["insecure"] = "true"
+	}
+}
+
+// none and zero are not supported by the vmess client
+func setVMessSecurity(proxy *proxyclient.ProxyInfo, security string) error {
+	switch security {
+	case "", "auto", "aes-128-gcm", "chacha20-poly1305":
+		proxy.Params["security"] = security
+		return nil
+	}
+	return fmt.Errorf("vmess security %s not supported", security)
+}
@@ -8,17 +8,34 @@ import (
 )
 
 type Config struct {
-	Key               string          `json:"key"`
-	UserName          string          `json:"username"`
-	PassWord          string          `json:"password"`
+	Key      string `json:"key"`
+	UserName string `json:"username"`
+	PassWord string `json:"password"`
+	// base64 ed25519 private key, the clients verify the list with the public key
+	SignKey           string          `json:"signkey"`
 	SrcFile           string          `json:"srcfile"`
+	Subscriptions     []*Subscription `json:"subscriptions"`
 	Target            *nctst.AddrInfo `json:"target"`
 	SelectPerGroup    int             `json:"selectpergroup"`
 	ClientTotalSelect int             `json:"clienttotalselect"`
-	PingThreadNum     int             `json:"pingthreadnum"`
-	PublishServer     *nctst.AddrInfo `json:"publishserver"`
-	PublishTimeout    int             `json:"publishtimeout"`
-	PublishRetry      int             `json:"publishretry"`
+	// overrides the srcfile selectpergroup for the clients
+	ClientSelectPerGroup int `json:"clientselectpergroup"`
+	PingThreadNum        int `json:"pingthreadnum"`
+	// pings per proxy and the speed test bytes (negative disables), ranked by the probe score
+	PingSamples   int `json:"pingsamples"`
+	SpeedTestSize int `json:"speedtestsize"`
+	// drops the nodes the clients failed to reach in the last hours, 0 disables
+	ProbeStatsHours    int             `json:"probestatshours"`
+	ProbeStatsMinCount int             `json:"probestatsmincount"`
+	PublishServer      *nctst.AddrInfo `json:"publishserver"`
+	PublishTimeout     int             `json:"publishtimeout"`
+	PublishRetry       int             `json:"publishretry"`
+	// minutes between the runs, 0 runs once
+	Interval int `json:"interval"`
+	// the daemon publishes when at least this many nodes are added, removed or changed
+	PublishMinChanges int    `json:"publishminchanges"`
+	HistoryFile       string `json:"historyfile"`
+	HistoryMax        int    `json:"historymax"`
 }
 
 func parseConfig(configFile string) (*Config, error) {
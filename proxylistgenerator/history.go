@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/PIngBZ/nctst/proxyclient"
+)
+
+type HistoryItem struct {
+	Version string    `json:"ver"`
+	Time    time.Time `json:"time"`
+	Nodes   []string  `json:"nodes"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	// nodes on the same address with other credentials or params
+	Changed []string `json:"changed"`
+	// digest of the serialized proxy per node
+	Digests map[string]string `json:"digests"`
+}
+
+// published versions, the last one is compared with the new selection
+type History struct {
+	file  string
+	max   int
+	Items []*HistoryItem `json:"items"`
+}
+
+func loadHistory(file string) *History {
+	h := &History{file: file, max: config.HistoryMax}
+	if h.max == 0 {
+		h.max = 100
+	}
+	if file == "" {
+		return h
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("loadHistory %+v\n", err)
+		}
+		return h
+	}
+
+	if err := json.Unmarshal(data, h); err != nil {
+		log.Printf("loadHistory %+v\n", err)
+	}
+	return h
+}
+
+// added, removed and changed nodes compared with the last published version
+func (h *History) Diff(proxyInfo *proxyclient.ProxyGroups) ([]string, []string, []string) {
+	last := &HistoryItem{}
+	if len(h.Items) > 0 {
+		last = h.Items[len(h.Items)-1]
+	}
+
+	lastNodes := make(map[string]bool)
+	for _, node := range last.Nodes {
+		lastNodes[node] = true
+	}
+
+	digests := historyDigests(proxyInfo)
+	added := make([]string, 0)
+	changed := make([]string, 0)
+	for _, node := range historyNodes(proxyInfo) {
+		if !lastNodes[node] {
+			added = append(added, node)
+		} else if last.Digests[node] != digests[node] {
+			changed = append(changed, node)
+		}
+	}
+
+	removed := make([]string, 0)
+	for node := range lastNodes {
+		if _, ok := digests[node]; !ok {
+			removed = append(removed, node)
+		}
+	}
+	sort.Strings(removed)
+
+	return added, removed, changed
+}
+
+func (h *History) Add(proxyInfo *proxyclient.ProxyGroups) {
+	added, removed, changed := h.Diff(proxyInfo)
+	log.Printf("History %s %d added, %d removed, %d changed\n", proxyInfo.Version, len(added), len(removed), len(changed))
+
+	h.Items = append(h.Items, &HistoryItem{
+		Version: proxyInfo.Version,
+		Time:    time.Now(),
+		Nodes:   historyNodes(proxyInfo),
+		Added:   added,
+		Removed: removed,
+		Changed: changed,
+		Digests: historyDigests(proxyInfo),
+	})
+	if len(h.Items) > h.max {
+		h.Items = h.Items[len(h.Items)-h.max:]
+	}
+
+	if h.file == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(h, "", "    ")
+	if err != nil {
+		log.Printf("History save %+v\n", err)
+		return
+	}
+	if err := os.WriteFile(h.file, data, 0644); err != nil {
+		log.Printf("History save %+v\n", err)
+	}
+}
+
+// nodes are identified by type and address so other credentials on the same
+// address are a change, the ping order is not a change
+func historyNodes(proxyInfo *proxyclient.ProxyGroups) []string {
+	nodes := make([]string, 0)
+	for node := range historyDigests(proxyInfo) {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// the json of the proxy has the credentials, params and via but not the
+// ping results, a node listed in several groups gets all its digests
+func historyDigests(proxyInfo *proxyclient.ProxyGroups) map[string]string {
+	all := make(map[string][]string)
+	for _, group := range proxyInfo.Groups {
+		for _, proxy := range group.List {
+			data, err := json.Marshal(proxy)
+			if err != nil {
+				log.Printf("historyDigests %s %+v\n", historyNode(proxy), err)
+				continue
+			}
+			sum := sha256.Sum256(data)
+			all[historyNode(proxy)] = append(all[historyNode(proxy)], hex.EncodeToString(sum[:8]))
+		}
+	}
+
+	digests := make(map[string]string, len(all))
+	for node, list := range all {
+		sort.Strings(list)
+		digests[node] = strings.Join(list, ",")
+	}
+	return digests
+}
+
+func historyNode(proxy *proxyclient.ProxyInfo) string {
+	return proxy.Type + "://" + proxy.Address()
+}
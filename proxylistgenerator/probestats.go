@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/PIngBZ/nctst/proxyclient"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// the measurements reported by the clients, per node and office
+func fetchProbeStats() (map[string][]*proxyclient.ProxyProbeStat, error) {
+	url := fmt.Sprintf("http://%s/proxyprobe/stats?hours=%d", config.PublishServer.Address(), config.ProbeStatsHours)
+	req, err := retryablehttp.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(config.UserName, config.PassWord)
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = time.Second * time.Duration(config.PublishTimeout)
+	client.RetryMax = config.PublishRetry
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("statuscode %d", response.StatusCode)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	apiResp := &struct {
+		Code nctst.APIResponseCode         `json:"code"`
+		Data []*proxyclient.ProxyProbeStat `json:"data"`
+	}{}
+	if err := json.Unmarshal(data, apiResp); err != nil {
+		return nil, err
+	}
+	if apiResp.Code != nctst.APIResponseCode_Success {
+		return nil, fmt.Errorf("response code %d", apiResp.Code)
+	}
+
+	stats := make(map[string][]*proxyclient.ProxyProbeStat)
+	for _, stat := range apiResp.Data {
+		stats[stat.Node] = append(stats[stat.Node], stat)
+	}
+	return stats, nil
+}
+
+// drops the nodes no office could reach in enough reports
+func filterByProbeStats(proxyInfo *proxyclient.ProxyGroups) {
+	stats, err := fetchProbeStats()
+	if err != nil {
+		log.Printf("filterByProbeStats %+v\n", err)
+		return
+	}
+
+	minCount := config.ProbeStatsMinCount
+	if minCount == 0 {
+		minCount = 3
+	}
+
+	groups := make([]*proxyclient.ProxyGroup, 0, len(proxyInfo.Groups))
+	for _, group := range proxyInfo.Groups {
+		list := make([]*proxyclient.ProxyInfo, 0, len(group.List))
+		for _, proxy := range group.List {
+			count, working := 0, 0
+			for _, stat := range stats[proxy.NodeID()] {
+				count += stat.Count
+				if stat.SuccessRate > 0 {
+					working++
+				}
+			}
+
+			if count >= minCount && working == 0 {
+				log.Printf("filterByProbeStats drop %s %s, failed in %d reports\n", proxy.NodeID(), proxy.Name, count)
+				continue
+			}
+			if count > 0 {
+				log.Printf("filterByProbeStats %s %s works from %d/%d offices\n", proxy.NodeID(), proxy.Name, working, len(stats[proxy.NodeID()]))
+			}
+			list = append(list, proxy)
+		}
+		if len(list) > 0 {
+			group.List = list
+			groups = append(groups, group)
+		}
+	}
+	proxyInfo.Groups = groups
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,6 +10,7 @@ import (
 	"io"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -19,14 +21,25 @@ import (
 var (
 	configFile string
 	config     *Config
+	signKey    ed25519.PrivateKey
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
 	nctst.OpenLog()
 
+	genKey := false
 	flag.StringVar(&configFile, "c", "", "configure file")
+	flag.BoolVar(&genKey, "genkey", false, "generate the sign key pair and exit")
 	flag.Parse()
+
+	if genKey {
+		privateKey, publicKey, err := proxyclient.GenerateSignKey()
+		nctst.CheckError(err)
+		fmt.Printf("signkey: %s\npublickey: %s\n", privateKey, publicKey)
+		os.Exit(0)
+	}
+
 	if configFile == "" {
 		if exist, _ := nctst.PathExists("config.json"); !exist {
 			nctst.CheckError(errors.New("no config file"))
@@ -39,13 +52,70 @@ func init() {
 	config, err = parseConfig(configFile)
 	nctst.CheckError(err)
 	nctst.CommandXorKey = config.Key
+
+	if config.SignKey == "" {
+		nctst.CheckError(errors.New("no signkey, generate one with -genkey"))
+	}
+	signKey, err = proxyclient.ParseSignPrivateKey(config.SignKey)
+	nctst.CheckError(err)
 }
 
 func main() {
+	history := loadHistory(config.HistoryFile)
+
+	if config.Interval == 0 {
+		if proxyInfo := generate(); proxyInfo != nil {
+			if err := publish(proxyInfo); err == nil {
+				history.Add(proxyInfo)
+			}
+		}
+		return
+	}
+
+	for {
+		if proxyInfo := generate(); proxyInfo != nil {
+			if added, removed, changed := history.Diff(proxyInfo); len(added)+len(removed)+len(changed) < nctst.Max(config.PublishMinChanges, 1) {
+				log.Printf("proxy list not changed, %d added, %d removed, %d changed\n", len(added), len(removed), len(changed))
+			} else if err := publish(proxyInfo); err == nil {
+				history.Add(proxyInfo)
+			}
+		}
+
+		log.Printf("next run after %d minutes\n", config.Interval)
+		time.Sleep(time.Minute * time.Duration(config.Interval))
+	}
+}
+
+// fetch the sources, ping and select
+func generate() *proxyclient.ProxyGroups {
 	fileInfo := &proxyclient.ProxyFile{Type: "file", Url: config.SrcFile}
-	pingTarget := &proxyclient.PingTarget{Target: config.Target, PingThreads: config.PingThreadNum}
+	pingTarget := &proxyclient.PingTarget{
+		Target:        config.Target,
+		PingThreads:   config.PingThreadNum,
+		PingSamples:   config.PingSamples,
+		SpeedTestSize: config.SpeedTestSize,
+	}
 
-	proxyInfo := proxyclient.GetProxyListFromFile(fileInfo)
+	var proxyInfo *proxyclient.ProxyGroups
+	if config.SrcFile != "" {
+		if proxyInfo = proxyclient.GetProxyListFromFile(fileInfo); proxyInfo == nil {
+			return nil
+		}
+	} else {
+		proxyInfo = &proxyclient.ProxyGroups{}
+	}
+	if config.ClientSelectPerGroup > 0 {
+		proxyInfo.SelectPerGroup = config.ClientSelectPerGroup
+	}
+
+	loadSubscriptions(proxyInfo, config.Subscriptions)
+	if config.ProbeStatsHours > 0 {
+		filterByProbeStats(proxyInfo)
+	}
+	if len(proxyInfo.Groups) == 0 {
+		log.Println("no proxy groups")
+		return nil
+	}
 
 	for _, group := range proxyInfo.Groups {
 		proxylist := proxyclient.PingSelectProxyFromList(group.List, config.SelectPerGroup, pingTarget, true)
@@ -53,16 +123,29 @@ func main() {
 	}
 	proxyInfo.ClientTotalSelect = config.ClientTotalSelect
 
+	return proxyInfo
+}
+
+func publish(proxyInfo *proxyclient.ProxyGroups) error {
+	proxyInfo.Version = time.Now().Format("20060102150405")
+
 	buf, err := json.Marshal(proxyInfo)
 	if err != nil {
 		log.Printf("ToJson %+v\n", err)
-		return
+		return err
 	}
 
 	log.Println(string(buf))
 
-	nctst.Xor(buf, []byte(config.Key))
-	nctst.Xor(buf, []byte(config.UserName))
+	if buf, err = proxyclient.SignProxyList(buf, signKey); err != nil {
+		log.Printf("SignProxyList %+v\n", err)
+		return err
+	}
+	secret := proxyclient.ProxyListSecret(config.Key, nctst.HashPassword(config.UserName, config.PassWord))
+	if buf, err = proxyclient.SealProxyList(buf, secret); err != nil {
+		log.Printf("SealProxyList %+v\n", err)
+		return err
+	}
 
 	client := retryablehttp.NewClient()
 	client.HTTPClient.Timeout = time.Second * time.Duration(config.PublishTimeout)
@@ -74,7 +157,7 @@ func main() {
 	req, err := retryablehttp.NewRequest("POST", url, buffer)
 	if err != nil {
 		log.Printf("NewRequest %+v\n", err)
-		return
+		return err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -83,31 +166,32 @@ func main() {
 	response, err := client.Do(req)
 	if err != nil {
 		log.Printf("http request %+v\n", err)
-		return
+		return err
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != 200 {
 		log.Printf("Error, StatusCode = %d\n", response.StatusCode)
-		return
+		return fmt.Errorf("statuscode %d", response.StatusCode)
 	}
 
 	ret, err := io.ReadAll(response.Body)
 	if err != nil {
 		log.Printf("ReadAll %+v\n", err)
-		return
+		return err
 	}
 
 	apiResp := &nctst.APIResponse{}
 	if err = json.Unmarshal(ret, apiResp); err != nil {
 		log.Printf("Error, Response json Unmarshal %+v\n", err)
-		return
+		return err
 	}
 
 	if apiResp.Code != nctst.APIResponseCode_Success {
 		log.Printf("Error, Response json code= %d\n", apiResp.Code)
-		return
+		return fmt.Errorf("response code %d", apiResp.Code)
 	}
 
 	log.Println(string(ret))
+	return nil
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/PIngBZ/nctst/proxyclient"
+)
+
+// ss:// ssr:// trojan:// vmess:// vless:// share links
+func parseShareLink(link string) (*proxyclient.ProxyInfo, error) {
+	scheme, rest, ok := strings.Cut(link, "://")
+	if !ok {
+		return nil, fmt.Errorf("share link error %s", link)
+	}
+
+	var proxy *proxyclient.ProxyInfo
+	var err error
+	switch strings.ToLower(scheme) {
+	case "ss":
+		proxy, err = parseSSLink(rest)
+	case "ssr":
+		proxy, err = parseSSRLink(rest)
+	case "trojan":
+		proxy, err = parseTrojanLink(link)
+	case "vmess":
+		proxy, err = parseVMessLink(rest)
+	case "vless":
+		proxy, err = parseVLESSLink(link)
+	default:
+		return nil, fmt.Errorf("share link %s not supported", scheme)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s link %w", scheme, err)
+	}
+	return proxy, nil
+}
+
+func newProxyInfo(proxyType, name, hostPort string) (*proxyclient.ProxyInfo, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyclient.ProxyInfo{
+		AddrInfo: nctst.AddrInfo{Host: host, Port: port},
+		Name:     name,
+		Type:     proxyType,
+		Params:   make(map[string]string),
+	}, nil
+}
+
+// sip002 ss://userinfo@host:port/?plugin=...#name, userinfo is base64 of
+// method:password or url encoded for 2022, or the legacy base64 of method:password@host:port
+func parseSSLink(rest string) (*proxyclient.ProxyInfo, error) {
+	rest, fragment, _ := strings.Cut(rest, "#")
+	name, _ := url.PathUnescape(fragment)
+
+	rest, query, _ := strings.Cut(rest, "?")
+	rest = strings.TrimSuffix(rest, "/")
+	if values, _ := url.ParseQuery(query); values.Get("plugin") != "" {
+		return nil, fmt.Errorf("plugin %s not supported", values.Get("plugin"))
+	}
+
+	var userInfo, hostPort string
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		userInfo, hostPort = rest[:i], rest[i+1:]
+		if decoded, err := decodeBase64(userInfo); err == nil && strings.Contains(string(decoded), ":") {
+			userInfo = string(decoded)
+		} else if userInfo, err = url.PathUnescape(userInfo); err != nil {
+			return nil, err
+		}
+	} else {
+		decoded, err := decodeBase64(rest)
+		if err != nil {
+			return nil, err
+		}
+		i := strings.LastIndex(string(decoded), "@")
+		if i < 0 {
+			return nil, errors.New("no server")
+		}
+		userInfo, hostPort = string(decoded[:i]), string(decoded[i+1:])
+	}
+
+	method, password, ok := strings.Cut(userInfo, ":")
+	if !ok {
+		return nil, errors.New("no password")
+	}
+
+	proxy, err := newProxyInfo("ss", name, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	proxy.Password = password
+	proxy.Params["cipher"] = method
+	return proxy, nil
+}
+
+// base64 of host:port:protocol:method:obfs:base64(password)/?obfsparam=&protoparam=&remarks=
+func parseSSRLink(rest string) (*proxyclient.ProxyInfo, error) {
+	decoded, err := decodeBase64(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	main, query, _ := strings.Cut(string(decoded), "/?")
+	main = strings.TrimSuffix(main, "/")
+
+	// the host may be ipv6, take the fields from the right
+	fields := strings.Split(main, ":")
+	if len(fields) < 6 {
+		return nil, errors.New("fields error")
+	}
+	n := len(fields)
+	host := strings.Join(fields[:n-5], ":")
+	password, err := decodeBase64(fields[n-1])
+	if err != nil {
+		return nil, err
+	}
+
+	values, _ := url.ParseQuery(query)
+	param := func(key string) string {
+		v, _ := decodeBase64(values.Get(key))
+		return string(v)
+	}
+
+	proxy, err := newProxyInfo("ssr", param("remarks"), net.JoinHostPort(host, fields[n-5]))
+	if err != nil {
+		return nil, err
+	}
+	proxy.Password = string(password)
+	proxy.Params["protocol"] = fields[n-4]
+	proxy.Params["cipher"] = fields[n-3]
+	proxy.Params["obfs"] = fields[n-2]
+	proxy.Params["obfs-param"] = param("obfsparam")
+	proxy.Params["protocol-param"] = param("protoparam")
+	return proxy, nil
+}
+
+// trojan://password@host:port?sni=&alpn=&allowInsecure=1&type=tcp#name
+func parseTrojanLink(link string) (*proxyclient.ProxyInfo, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	if network := query.Get("type"); network != "" && network != "tcp" {
+		return nil, fmt.Errorf("network %s not supported", network)
+	}
+
+	proxy, err := newProxyInfo("trojan", u.Fragment, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	proxy.Password = u.User.Username()
+
+	sni := query.Get("sni")
+	if sni == "" {
+		sni = query.Get("peer")
+	}
+	setTLSParams(proxy, sni, query.Get("alpn"), query.Get("allowInsecure") == "1" || query.Get("allowInsecure") == "true")
+	return proxy, nil
+}
+
+// base64 of the v2rayN json, the numbers may be strings
+func parseVMessLink(rest string) (*proxyclient.ProxyInfo, error) {
+	decoded, err := decodeBase64(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	var item clashProxy
+	if err := json.Unmarshal(decoded, &item); err != nil {
+		return nil, err
+	}
+
+	if aid := item.String("aid"); aid != "" && aid != "0" {
+		return nil, fmt.Errorf("alterId %s not supported", aid)
+	}
+
+	proxy, err := newProxyInfo("vmess", item.String("ps"), net.JoinHostPort(item.String("add"), item.String("port")))
+	if err != nil {
+		return nil, err
+	}
+	proxy.Password = item.String("id")
+	if err := setVMessSecurity(proxy, item.String("scy")); err != nil {
+		return nil, err
+	}
+
+	if err := setTransportParams(proxy, item.String("net"), item.String("path"), item.String("host")); err != nil {
+		return nil, err
+	}
+	if item.String("tls") == "tls" {
+		proxy.Params["tls"] = "true"
+		setTLSParams(proxy, item.String("sni"), item.String("alpn"), false)
+	}
+	return proxy, nil
+}
+
+// vless://uuid@host:port?type=ws&security=tls&sni=&path=&host=#name
+func parseVLESSLink(link string) (*proxyclient.ProxyInfo, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	if flow := query.Get("flow"); flow != "" {
+		return nil, fmt.Errorf("flow %s not supported", flow)
+	}
+
+	proxy, err := newProxyInfo("vless", u.Fragment, u.Host)
+	if err != nil {
+		return nil, err
+	}
+	proxy.Password = u.User.Username()
+
+	if err := setTransportParams(proxy, query.Get("type"), query.Get("path"), query.Get("host")); err != nil {
+		return nil, err
+	}
+
+	switch security := query.Get("security"); security {
+	case "", "none":
+	case "tls":
+		proxy.Params["tls"] = "true"
+		setTLSParams(proxy, query.Get("sni"), query.Get("alpn"), query.Get("allowInsecure") == "1")
+	default:
+		return nil, fmt.Errorf("security %s not supported", security)
+	}
+	return proxy, nil
+}
+
+func setTransportParams(proxy *proxyclient.ProxyInfo, network, path, host string) error {
+	switch network {
+	case "", "tcp":
+	case "ws":
+		proxy.Params["network"] = "ws"
+		proxy.Params["path"] = path
+		proxy.Params["host"] = host
+	default:
+		return fmt.Errorf("network %s not supported", network)
+	}
+	return nil
+}
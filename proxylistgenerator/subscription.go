@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/PIngBZ/nctst/proxyclient"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// url is a http(s) subscription or a local file,
+// the content is a clash yaml or a (base64) list of share links
+type Subscription struct {
+	Name      string `json:"name"`
+	Url       string `json:"url"`
+	UserAgent string `json:"useragent"`
+	ConnNum   int    `json:"connnum"`
+}
+
+var regions = []struct {
+	Name     string
+	Codes    []string
+	Keywords []string
+}{
+	{"HK", []string{"HK", "HKG"}, []string{"香港", "hong kong", "hongkong", "🇭🇰"}},
+	{"TW", []string{"TW", "TWN"}, []string{"台湾", "臺灣", "taiwan", "🇹🇼"}},
+	{"JP", []string{"JP", "JPN"}, []string{"日本", "japan", "东京", "大阪", "🇯🇵"}},
+	{"SG", []string{"SG", "SGP"}, []string{"新加坡", "狮城", "singapore", "🇸🇬"}},
+	{"KR", []string{"KR", "KOR"}, []string{"韩国", "korea", "首尔", "🇰🇷"}},
+	{"US", []string{"US", "USA"}, []string{"美国", "united states", "los angeles", "🇺🇸"}},
+	{"UK", []string{"UK", "GB", "GBR"}, []string{"英国", "united kingdom", "london", "🇬🇧"}},
+	{"DE", []string{"DE", "DEU"}, []string{"德国", "germany", "frankfurt", "🇩🇪"}},
+	{"RU", []string{"RU", "RUS"}, []string{"俄罗斯", "russia", "🇷🇺"}},
+}
+
+func loadSubscriptions(proxyGroups *proxyclient.ProxyGroups, subscriptions []*Subscription) {
+	seen := make(map[string]bool)
+	for _, group := range proxyGroups.Groups {
+		for _, proxy := range group.List {
+			seen[proxyKey(proxy)] = true
+		}
+	}
+
+	for _, sub := range subscriptions {
+		data, err := fetchSubscription(sub)
+		if err != nil {
+			log.Printf("loadSubscriptions fetch %s %+v\n", sub.Name, err)
+			continue
+		}
+
+		proxies, err := parseSubscription(data)
+		if err != nil {
+			log.Printf("loadSubscriptions parse %s %+v\n", sub.Name, err)
+			continue
+		}
+
+		connNum := sub.ConnNum
+		if connNum == 0 {
+			connNum = 3
+		}
+
+		groups := make(map[string]*proxyclient.ProxyGroup)
+		added, duplicated := 0, 0
+		for _, proxy := range proxies {
+			key := proxyKey(proxy)
+			if seen[key] {
+				duplicated++
+				continue
+			}
+			seen[key] = true
+
+			proxy.ConnNum = connNum
+
+			name := sub.Name + "-" + proxyRegion(proxy.Name)
+			group, ok := groups[name]
+			if !ok {
+				group = &proxyclient.ProxyGroup{Name: name}
+				groups[name] = group
+				proxyGroups.Groups = append(proxyGroups.Groups, group)
+			}
+			group.List = append(group.List, proxy)
+			added++
+		}
+
+		log.Printf("loadSubscriptions %s %d added, %d duplicated\n", sub.Name, added, duplicated)
+	}
+}
+
+func fetchSubscription(sub *Subscription) ([]byte, error) {
+	if !strings.HasPrefix(sub.Url, "http://") && !strings.HasPrefix(sub.Url, "https://") {
+		return os.ReadFile(sub.Url)
+	}
+
+	req, err := retryablehttp.NewRequest("GET", sub.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if sub.UserAgent != "" {
+		req.Header.Set("User-Agent", sub.UserAgent)
+	}
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient.Timeout = time.Second * 15
+	client.RetryMax = 3
+
+	response, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("statuscode %d", response.StatusCode)
+	}
+
+	return io.ReadAll(response.Body)
+}
+
+func parseSubscription(data []byte) ([]*proxyclient.ProxyInfo, error) {
+	if proxies, ok := parseClash(data); ok {
+		return proxies, nil
+	}
+
+	content := strings.TrimSpace(string(data))
+	if !strings.Contains(content, "://") {
+		decoded, err := decodeBase64(content)
+		if err != nil {
+			return nil, errors.New("unknown subscription format")
+		}
+		content = string(decoded)
+	}
+
+	proxies := make([]*proxyclient.ProxyInfo, 0)
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		proxy, err := parseShareLink(line)
+		if err != nil {
+			log.Printf("parseSubscription skip %+v\n", err)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxy")
+	}
+	return proxies, nil
+}
+
+// the same server from different subscriptions
+func proxyKey(proxy *proxyclient.ProxyInfo) string {
+	return strings.Join([]string{proxy.Type, proxy.Address(), proxy.LoginName, proxy.Password}, "|")
+}
+
+func proxyRegion(name string) string {
+	lower := strings.ToLower(name)
+
+	tokens := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) || r > unicode.MaxASCII
+	})
+
+	for _, region := range regions {
+		for _, keyword := range region.Keywords {
+			if strings.Contains(lower, keyword) {
+				return region.Name
+			}
+		}
+		for _, token := range tokens {
+			for _, code := range region.Codes {
+				if token == code {
+					return region.Name
+				}
+			}
+		}
+	}
+	return "Other"
+}
+
+// subscriptions mix the std and url alphabets, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+
+	var err error
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		var data []byte
+		if data, err = encoding.DecodeString(s); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
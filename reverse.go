@@ -0,0 +1,55 @@
+package nctst
+
+import (
+	"errors"
+	"io"
+)
+
+// the client registers a server port with the key and the port, the server
+// answers with an empty string or the error and keeps the listener while the
+// stream is open
+func WriteReverseRegister(writer io.Writer, port int) error {
+	if err := WriteUInt(writer, REVERSE_KEY); err != nil {
+		return err
+	}
+	return WriteUInt(writer, uint32(port))
+}
+
+func WriteReverseResult(writer io.Writer, err error) error {
+	if err == nil {
+		return WriteLString(writer, "")
+	}
+	return WriteLString(writer, err.Error())
+}
+
+func ReadReverseResult(reader io.Reader) error {
+	s, err := ReadLString(reader)
+	if err != nil {
+		return err
+	}
+	if s != "" {
+		return errors.New(s)
+	}
+	return nil
+}
+
+// every accepted connection is a server initiated stream starting with the
+// registered port and the remote address
+func WriteReverseHeader(writer io.Writer, port int, remote string) error {
+	if err := WriteUInt(writer, uint32(port)); err != nil {
+		return err
+	}
+	return WriteLString(writer, remote)
+}
+
+func ReadReverseHeader(reader io.Reader) (int, string, error) {
+	port, err := ReadUInt(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	remote, err := ReadLString(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	return int(port), remote, nil
+}
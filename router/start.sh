@@ -1,5 +1,14 @@
 #!/bin/sh
 
-redsocks -c redsocks.conf
+# client config.json: "transparentlisten": ":1082", "transparentmode": "redirect"
+./client -c config.json -d $1 &
 
-iptables -t nat -I PREROUTING -p tcp -d 192.168.100.1/24 -j REDIRECT --to-ports 1082
\ No newline at end of file
+iptables -t nat -I PREROUTING -p tcp -d 192.168.100.1/24 -j REDIRECT --to-ports 1082
+
+# dns of the LAN through the client, "dns": {"listen": ":1053", "domains": ["corp.internal"]}
+# iptables -t nat -I PREROUTING -p udp --dport 53 -j REDIRECT --to-ports 1053
+
+# ipv6 with tproxy, "transparentmode": "tproxy"
+# ip -6 rule add fwmark 1 lookup 100
+# ip -6 route add local ::/0 dev lo table 100
+# ip6tables -t mangle -I PREROUTING -p tcp -d fd00:100::/64 -j TPROXY --on-port 1082 --tproxy-mark 1
@@ -16,12 +16,14 @@ import (
 )
 
 type Client struct {
-	User    *UserInfo
-	UUID    string
-	ID      uint
-	ConnKey string
+	User      *UserInfo
+	UUID      string
+	Device    string
+	ID        uint
+	ConnKey   string
+	LoginTime time.Time
 
-	proxyIPNet *net.IPNet
+	proxyIPNet atomic.Pointer[net.IPNet]
 
 	kcp            *nctst.Kcp
 	smux           *smux.Session
@@ -36,31 +38,30 @@ type Client struct {
 
 	receiveCounter atomic.Int64
 	sendCounter    atomic.Int64
+	receiveSpeed   *nctst.SpeedCounter
+	sendSpeed      *nctst.SpeedCounter
 
 	die     chan struct{}
 	dieOnce sync.Once
 }
 
-func NewClient(user *UserInfo, uuid string, id uint, compress bool, logoutNotify chan string) *Client {
+func NewClient(user *UserInfo, uuid string, device string, id uint, compress bool, logoutNotify chan string) *Client {
 	h := &Client{}
 	h.User = user
 	h.UUID = uuid
+	h.Device = device
 	h.ID = id
 	k := md5.Sum([]byte(uuid))
 	h.ConnKey = hex.EncodeToString(k[:])
+	h.LoginTime = time.Now()
+	h.receiveSpeed = nctst.NewSpeedCounter()
+	h.sendSpeed = nctst.NewSpeedCounter()
 	h.die = make(chan struct{})
 	h.logoutNotify = logoutNotify
 
 	go h.saveCountLoop()
 
-	if !h.User.Proxy && len(config.Localnetmask) > 0 {
-		_, ipNet, err := net.ParseCIDR(config.Localnetmask)
-		if err != nil {
-			log.Printf("NewClient ParseCIDR: %+v\n", err)
-		} else {
-			h.proxyIPNet = ipNet
-		}
-	}
+	h.updateProxyIPNet()
 
 	h.kcp = nctst.NewKcp(id)
 	if compress {
@@ -68,7 +69,7 @@ func NewClient(user *UserInfo, uuid string, id uint, compress bool, logoutNotify
 	} else {
 		h.smux, _ = smux.Server(h.kcp, nctst.SmuxConfig())
 	}
-	h.listener = NewSmuxWrapper(h.smux)
+	h.listener = NewSmuxWrapper(h.smux, h.serveUDPRelay, h.serveReverse, h.serveDNSRelay)
 
 	h.tunnels = make(map[uint]*nctst.OuterTunnel)
 	h.tunnelsListVer = 100
@@ -89,7 +90,7 @@ func NewClient(user *UserInfo, uuid string, id uint, compress bool, logoutNotify
 
 	go h.listenAndServeSocks5()
 
-	log.Printf("Client.New %s %d\n", uuid, id)
+	log.Printf("Client.New %s %s %d\n", uuid, device, id)
 	return h
 }
 
@@ -130,7 +131,7 @@ func (h *Client) AddConn(conn *net.TCPConn, tunnelID uint, connID uint) {
 	h.tunnelsLocker.Lock()
 	tunnel, ok := h.tunnels[tunnelID]
 	if !ok {
-		tunnel = nctst.NewOuterTunnel(config.Key, tunnelID, h.ID, h.kcp.InputChan, h.duplicater.Output, h.logoutNotify)
+		tunnel = nctst.NewOuterTunnel(currentConfig().Key, tunnelID, h.ID, h.kcp.InputChan, h.duplicater.Output, h.logoutNotify)
 		h.tunnels[tunnelID] = tunnel
 		atomic.AddUint32(&h.tunnelsListVer, 1)
 	}
@@ -139,9 +140,53 @@ func (h *Client) AddConn(conn *net.TCPConn, tunnelID uint, connID uint) {
 	tunnel.AddConn(conn, connID)
 }
 
+func (h *Client) updateProxyIPNet() {
+	if h.User.Proxy || len(currentConfig().Localnetmask) == 0 {
+		h.proxyIPNet.Store(nil)
+		return
+	}
+
+	_, ipNet, err := net.ParseCIDR(currentConfig().Localnetmask)
+	if err != nil {
+		log.Printf("updateProxyIPNet ParseCIDR: %+v\n", err)
+		return
+	}
+	h.proxyIPNet.Store(ipNet)
+}
+
+func (h *Client) Tunnels() []*nctst.OuterTunnel {
+	h.tunnelsLocker.Lock()
+	defer h.tunnelsLocker.Unlock()
+
+	tunnels := make([]*nctst.OuterTunnel, 0, len(h.tunnels))
+	for _, tunnel := range h.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels
+}
+
+// waits a while for the tunnels to send the reason before the logout closes them
+func (h *Client) Kickout(reason string) {
+	cmd := &nctst.CommandKickout{}
+	cmd.ClientUUID = h.UUID
+	cmd.Reason = reason
+
+	var wg sync.WaitGroup
+	for _, tunnel := range h.Tunnels() {
+		wg.Add(1)
+		go func(tunnel *nctst.OuterTunnel) {
+			defer wg.Done()
+			if !tunnel.SendCommandWait(&nctst.Command{Type: nctst.Cmd_kickout, Item: cmd}, time.Second*3) {
+				log.Printf("Kickout send timeout %s tunnel %d\n", h.UUID, tunnel.ID)
+			}
+		}(tunnel)
+	}
+	wg.Wait()
+}
+
 func (h *Client) listenAndServeSocks5() {
 	h.socks5 = &socks5.Server{
-		Addr:                   config.Listen,
+		Addr:                   currentConfig().Listen,
 		Authenticators:         nil,
 		DisableSocks4:          true,
 		Transporter:            h,
@@ -155,8 +200,28 @@ func (h *Client) listenAndServeSocks5() {
 }
 
 func (h *Client) TransportStream(client io.ReadWriteCloser, remote io.ReadWriteCloser) <-chan error {
-	nctst.TransferWithCounter(client, remote, &h.receiveCounter, &h.sendCounter)
-	return nil
+	var target string
+	if conn, ok := client.(*HandshakeRecordConn); ok {
+		var err error
+		if target, err = conn.Target(); err != nil {
+			log.Printf("TransportStream parse target: %+v\n", err)
+		}
+	}
+	if target == "" {
+		if conn, ok := remote.(net.Conn); ok {
+			target = conn.RemoteAddr().String()
+		}
+	}
+
+	record := connTracker.Open(h, target)
+	err := nctst.TransferWithCounter(client, remote,
+		nctst.MultiCounter{&h.receiveCounter, h.receiveSpeed, &record.receiveCounter},
+		nctst.MultiCounter{&h.sendCounter, h.sendSpeed, &record.sendCounter})
+	connTracker.Close(record, closeReason(err))
+
+	errCh := make(chan error)
+	close(errCh)
+	return errCh
 }
 
 func (h *Client) TransportUDP(server *socks5.UDPConn, request *socks5.Request) error {
@@ -164,19 +229,28 @@ func (h *Client) TransportUDP(server *socks5.UDPConn, request *socks5.Request) e
 }
 
 func (h *Client) CallbackAfterHandshake(srv *socks5.Server, req *socks5.Request) bool {
-	if h.proxyIPNet != nil {
-		return h.proxyIPNet.Contains(req.Address.Addr)
+	if ipNet := h.proxyIPNet.Load(); ipNet != nil {
+		return ipNet.Contains(req.Address.Addr)
 	}
 	return true
 }
 
 func (h *Client) saveCountLoop() {
+	saveTicker := time.NewTicker(time.Minute * 10)
+	defer saveTicker.Stop()
+
+	speedTicker := time.NewTicker(time.Second * 2)
+	defer speedTicker.Stop()
+
 	for {
 		select {
 		case <-h.die:
 			return
-		case <-time.Tick(time.Minute * 10):
+		case <-saveTicker.C:
 			h.saveCount(false)
+		case <-speedTicker.C:
+			h.receiveSpeed.Sample()
+			h.sendSpeed.Sample()
 		}
 	}
 }
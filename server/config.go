@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"os"
 	"strconv"
+
+	"github.com/PIngBZ/nctst/proxyclient"
 )
 
 type Config struct {
@@ -14,9 +18,17 @@ type Config struct {
 	Localnetmask  string `json:"localnetmask"`
 	AdminListen   string `json:"adminlisten"`
 	AdminPassword string `json:"adminpwd"`
+	MaxDevices    int    `json:"maxdevices"`
+	ConnLog       bool   `json:"connlog"`
+	RawRetention  int    `json:"rawretentiondays"`
+	ReverseHost   string `json:"reversehost"`
+	DNSServer     string `json:"dnsserver"`
 	Test          bool   `json:"test"`
+	// base64 ed25519 public key of the proxy list publisher, empty accepts any signer
+	ProxyListPublicKey string `json:"proxylistpublickey"`
 
-	PingUrl string
+	PingUrl      string
+	ProxyListKey ed25519.PublicKey `json:"-"`
 }
 
 func parseConfig(configFile string) (*Config, error) {
@@ -32,6 +44,14 @@ func parseConfig(configFile string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.MaxDevices <= 0 {
+		cfg.MaxDevices = 1
+	}
+
+	if len(cfg.AdminListen) == 0 {
+		return nil, errors.New("adminlisten is empty")
+	}
+
 	var pingUrl string
 	if cfg.AdminListen[0] == ':' {
 		pingUrl = "http://127.0.0.1" + cfg.AdminListen
@@ -40,6 +60,10 @@ func parseConfig(configFile string) (*Config, error) {
 	}
 	cfg.PingUrl = pingUrl + "/ping"
 
+	if cfg.ProxyListKey, err = proxyclient.ParseSignPublicKey(cfg.ProxyListPublicKey); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
 
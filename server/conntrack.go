@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	connTrackerRecentNum = 1000
+	handshakeRecordMax   = 512
+)
+
+var (
+	connTracker = NewConnTracker()
+)
+
+type ConnRecord struct {
+	ID          uint64    `json:"id"`
+	UserName    string    `json:"username"`
+	Device      string    `json:"device"`
+	ClientID    uint      `json:"clientid"`
+	Target      string    `json:"target"`
+	StartTime   time.Time `json:"starttime"`
+	EndTime     time.Time `json:"endtime"`
+	Duration    int64     `json:"duration"`
+	Send        int64     `json:"send"`
+	Receive     int64     `json:"receive"`
+	CloseReason string    `json:"closereason"`
+	Active      bool      `json:"active"`
+
+	sendCounter    atomic.Int64
+	receiveCounter atomic.Int64
+}
+
+func (h *ConnRecord) FormatSend() string {
+	return humanize.Bytes(uint64(h.Send))
+}
+
+func (h *ConnRecord) FormatReceive() string {
+	return humanize.Bytes(uint64(h.Receive))
+}
+
+func (h *ConnRecord) snapshot() *ConnRecord {
+	c := &ConnRecord{}
+	c.ID = h.ID
+	c.UserName = h.UserName
+	c.Device = h.Device
+	c.ClientID = h.ClientID
+	c.Target = h.Target
+	c.StartTime = h.StartTime
+	c.EndTime = h.EndTime
+	c.CloseReason = h.CloseReason
+	c.Active = h.Active
+	c.Send = h.sendCounter.Load()
+	c.Receive = h.receiveCounter.Load()
+	if c.Active {
+		c.Duration = int64(time.Since(c.StartTime) / time.Second)
+	} else {
+		c.Duration = int64(c.EndTime.Sub(c.StartTime) / time.Second)
+	}
+	return c
+}
+
+type ConnFilter struct {
+	UserName string
+	Target   string
+	Active   bool
+}
+
+func (h *ConnFilter) match(record *ConnRecord) bool {
+	if h.Active && !record.Active {
+		return false
+	}
+	if h.UserName != "" && h.UserName != record.UserName {
+		return false
+	}
+	if h.Target != "" && !strings.Contains(record.Target, h.Target) {
+		return false
+	}
+	return true
+}
+
+type ConnTracker struct {
+	nextID  uint64
+	active  map[uint64]*ConnRecord
+	recent  []*ConnRecord
+	recentN int
+	locker  sync.Mutex
+}
+
+func NewConnTracker() *ConnTracker {
+	h := &ConnTracker{}
+	h.active = make(map[uint64]*ConnRecord)
+	h.recent = make([]*ConnRecord, connTrackerRecentNum)
+	return h
+}
+
+func (h *ConnTracker) Open(client *Client, target string) *ConnRecord {
+	record := &ConnRecord{}
+	record.UserName = client.User.UserName
+	record.Device = client.Device
+	record.ClientID = client.ID
+	record.Target = target
+	record.StartTime = time.Now()
+	record.Active = true
+
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	h.nextID++
+	record.ID = h.nextID
+	h.active[record.ID] = record
+	return record
+}
+
+func (h *ConnTracker) Close(record *ConnRecord, reason string) {
+	h.locker.Lock()
+	record.EndTime = time.Now()
+	record.CloseReason = reason
+	record.Active = false
+	delete(h.active, record.ID)
+	h.recent[h.recentN%connTrackerRecentNum] = record
+	h.recentN++
+	snapshot := record.snapshot()
+	h.locker.Unlock()
+
+	if currentConfig().ConnLog {
+		saveConnRecord(snapshot)
+	}
+}
+
+func (h *ConnTracker) Query(filter *ConnFilter) []*ConnRecord {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	result := make([]*ConnRecord, 0)
+	for _, record := range h.active {
+		if filter.match(record) {
+			result = append(result, record.snapshot())
+		}
+	}
+
+	if filter.Active {
+		return result
+	}
+
+	for i := 1; i <= nctst.Min(h.recentN, connTrackerRecentNum); i++ {
+		record := h.recent[(h.recentN-i)%connTrackerRecentNum]
+		if filter.match(record) {
+			result = append(result, record.snapshot())
+		}
+	}
+	return result
+}
+
+func saveConnRecord(record *ConnRecord) {
+	cmd := "insert into connlog(username,device,clientid,target,starttime,endtime,send,receive,closereason) values(?,?,?,?,?,?,?,?,?)"
+	if _, err := DB.Exec(cmd, record.UserName, record.Device, record.ClientID, record.Target,
+		record.StartTime.UTC(), record.EndTime.UTC(), record.Send, record.Receive, record.CloseReason); err != nil {
+		log.Printf("saveConnRecord error: %+v\n", err)
+	}
+}
+
+func queryConnHistory(filter *ConnFilter, from, to time.Time, limit int) ([]*ConnRecord, error) {
+	cmd := "select id,username,device,clientid,target,starttime,endtime,send,receive,closereason from connlog where endtime>=? and starttime<=?"
+	args := []interface{}{from.UTC(), to.UTC()}
+	if filter.UserName != "" {
+		cmd += " and username=?"
+		args = append(args, filter.UserName)
+	}
+	if filter.Target != "" {
+		cmd += " and target like ?"
+		args = append(args, "%"+filter.Target+"%")
+	}
+	cmd += " order by starttime desc limit ?"
+	args = append(args, limit)
+
+	rows, err := DB.Query(cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*ConnRecord, 0)
+	for rows.Next() {
+		record := &ConnRecord{}
+		if err = rows.Scan(&record.ID, &record.UserName, &record.Device, &record.ClientID, &record.Target,
+			&record.StartTime, &record.EndTime, &record.Send, &record.Receive, &record.CloseReason); err != nil {
+			return nil, err
+		}
+		record.Duration = int64(record.EndTime.Sub(record.StartTime) / time.Second)
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+// records the socks5 handshake read from the client, so the requested target
+// is known when the stream is transported
+type HandshakeRecordConn struct {
+	net.Conn
+
+	head      []byte
+	recording bool
+}
+
+func NewHandshakeRecordConn(conn net.Conn) *HandshakeRecordConn {
+	h := &HandshakeRecordConn{}
+	h.Conn = conn
+	h.recording = true
+	return h
+}
+
+func (h *HandshakeRecordConn) Read(p []byte) (int, error) {
+	n, err := h.Conn.Read(p)
+	if h.recording && n > 0 && len(h.head) < handshakeRecordMax {
+		h.head = append(h.head, p[:nctst.Min(n, handshakeRecordMax-len(h.head))]...)
+	}
+	return n, err
+}
+
+func (h *HandshakeRecordConn) Target() (string, error) {
+	h.recording = false
+	head := h.head
+	h.head = nil
+
+	// greeting: VER NMETHODS METHODS
+	if len(head) < 2 || head[0] != 5 || len(head) < 2+int(head[1]) {
+		return "", errors.New("socks5 greeting error")
+	}
+	head = head[2+int(head[1]):]
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if len(head) < 4 || head[0] != 5 {
+		return "", errors.New("socks5 request error")
+	}
+	atyp := head[3]
+	head = head[4:]
+
+	var host string
+	switch atyp {
+	case 1:
+		if len(head) < net.IPv4len+2 {
+			return "", errors.New("socks5 ipv4 address error")
+		}
+		host = net.IP(head[:net.IPv4len]).String()
+		head = head[net.IPv4len:]
+	case 3:
+		if len(head) < 1 || len(head) < 1+int(head[0])+2 {
+			return "", errors.New("socks5 domain address error")
+		}
+		host = string(head[1 : 1+int(head[0])])
+		head = head[1+int(head[0]):]
+	case 4:
+		if len(head) < net.IPv6len+2 {
+			return "", errors.New("socks5 ipv6 address error")
+		}
+		host = net.IP(head[:net.IPv6len]).String()
+		head = head[net.IPv6len:]
+	default:
+		return "", errors.New("socks5 address type error")
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(head[:2])))), nil
+}
+
+func closeReason(err error) string {
+	if err == nctst.ErrTransferFirstClosed {
+		return "client closed"
+	} else if err == nctst.ErrTransferSecondClosed {
+		return "remote closed"
+	} else if err != nil {
+		return err.Error()
+	}
+	return ""
+}
@@ -12,7 +12,7 @@ import (
 
 var (
 	DB               *sql.DB
-	CurrentDBVersion = 101
+	CurrentDBVersion = 103
 )
 
 func init() {
@@ -23,16 +23,19 @@ func init() {
 	createConfigTable(db)
 	createUserTable(db)
 	createDataCountTable(db)
+	createDataCountRollupTables(db)
+	createConnLogTable(db)
+	createProxyProbeTable(db)
 
 	upgradeDatabase()
 }
 
 func createAminUser() {
 	cmd := "insert into userinfo(username,realname,password,admin,proxy) values(?,?,?,?,?)"
-	DB.Exec(cmd, "admin", "Administrator", nctst.HashPassword("admin", config.AdminPassword), 1, 1)
+	DB.Exec(cmd, "admin", "Administrator", nctst.HashPassword("admin", currentConfig().AdminPassword), 1, 1)
 
-	cmd = "upadte userinfo set password=? where username=admin"
-	DB.Exec(cmd, nctst.HashPassword("admin", config.AdminPassword))
+	cmd = "update userinfo set password=? where username='admin'"
+	DB.Exec(cmd, nctst.HashPassword("admin", currentConfig().AdminPassword))
 }
 
 func createConfigTable(db *sql.DB) {
@@ -79,6 +82,26 @@ func createDataCountTable(db *sql.DB) {
 	nctst.CheckError(err)
 }
 
+func createConnLogTable(db *sql.DB) {
+	cmd := `
+		CREATE TABLE IF NOT EXISTS connlog (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username VARCHAR(64),
+			device VARCHAR(64),
+			clientid INTEGER DEFAULT 0,
+			target VARCHAR(300),
+			starttime TIMESTAMP,
+			endtime TIMESTAMP,
+			send INTEGER DEFAULT 0,
+			receive INTEGER DEFAULT 0,
+			closereason VARCHAR(256)
+		);
+		CREATE INDEX IF NOT EXISTS connlog_time ON connlog(starttime, endtime);
+	`
+	_, err := db.Exec(cmd)
+	nctst.CheckError(err)
+}
+
 func upgradeDatabase() {
 	ver, _ := GetConfigIntFromDB("dbversion")
 
@@ -90,6 +113,12 @@ func upgradeDatabase() {
 		case ver < 101:
 			upgrade101()
 			fallthrough
+		case ver < 102:
+			upgrade102()
+			fallthrough
+		case ver < 103:
+			upgrade103()
+			fallthrough
 		default:
 		}
 
@@ -108,3 +137,13 @@ func upgrade101() {
 	_, err := DB.Exec("alter table userinfo add column nocodelogin INTEGER DEFAULT 0")
 	nctst.CheckError(err)
 }
+
+func upgrade102() {
+	_, err := DB.Exec("alter table userinfo add column maxdevices INTEGER DEFAULT 0")
+	nctst.CheckError(err)
+}
+
+func upgrade103() {
+	_, err := DB.Exec("alter table userinfo add column reverseports VARCHAR(256) DEFAULT ''")
+	nctst.CheckError(err)
+}
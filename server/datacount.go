@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+type TrafficPeriod struct {
+	Table  string
+	Format string
+}
+
+var (
+	TrafficPeriodHour  = &TrafficPeriod{Table: "datacount_hour", Format: "%Y-%m-%d %H:00"}
+	TrafficPeriodDay   = &TrafficPeriod{Table: "datacount_day", Format: "%Y-%m-%d"}
+	TrafficPeriodMonth = &TrafficPeriod{Table: "datacount_month", Format: "%Y-%m"}
+
+	trafficPeriods = map[string]*TrafficPeriod{
+		"hour":  TrafficPeriodHour,
+		"day":   TrafficPeriodDay,
+		"month": TrafficPeriodMonth,
+	}
+
+	rollupLocker sync.Mutex
+)
+
+type TrafficPoint struct {
+	Period  string `json:"period"`
+	Send    uint64 `json:"send"`
+	Receive uint64 `json:"receive"`
+}
+
+func createDataCountRollupTables(db *sql.DB) {
+	for _, period := range trafficPeriods {
+		cmd := fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username VARCHAR(64),
+				period VARCHAR(16),
+				send INTEGER DEFAULT 0,
+				receive INTEGER DEFAULT 0,
+				UNIQUE(username, period)
+			);
+		`, period.Table)
+		_, err := db.Exec(cmd)
+		nctst.CheckError(err)
+	}
+}
+
+func rollupDataCountLoop() {
+	ticker := time.NewTicker(time.Minute * 10)
+	defer ticker.Stop()
+
+	for {
+		if err := rollupDataCount(); err != nil {
+			log.Printf("rollupDataCount error: %+v\n", err)
+		}
+		cleanRawDataCount()
+		<-ticker.C
+	}
+}
+
+// accumulates the raw datacount rows saved since the last rollup into the aggregate tables
+func rollupDataCount() error {
+	rollupLocker.Lock()
+	defer rollupLocker.Unlock()
+
+	lastID, _ := GetConfigIntFromDB("rollupid")
+
+	var maxID sql.NullInt64
+	if err := DB.QueryRow("select max(id) from datacount").Scan(&maxID); err != nil {
+		return err
+	}
+	if !maxID.Valid || int(maxID.Int64) <= lastID {
+		return nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, period := range trafficPeriods {
+		cmd := fmt.Sprintf(`insert into %s(username,period,send,receive)
+			select username,strftime('%s',savetime),sum(send),sum(receive) from datacount where id>? and id<=? group by 1,2
+			on conflict(username,period) do update set send=send+excluded.send, receive=receive+excluded.receive`, period.Table, period.Format)
+		if _, err := tx.Exec(cmd, lastID, maxID.Int64); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("update config set value=? where key='rollupid'", maxID.Int64); err != nil {
+		tx.Rollback()
+		return err
+	} else if _, err := tx.Exec("insert or ignore into config(key,value) values('rollupid',?)", maxID.Int64); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func cleanRawDataCount() {
+	if currentConfig().RawRetention <= 0 {
+		return
+	}
+
+	lastID, _ := GetConfigIntFromDB("rollupid")
+	cmd := "delete from datacount where id<=? and savetime<datetime('now',?)"
+	if _, err := DB.Exec(cmd, lastID, fmt.Sprintf("-%d days", currentConfig().RawRetention)); err != nil {
+		log.Printf("cleanRawDataCount error: %+v\n", err)
+	}
+}
+
+// returns the last n points of one user, oldest first
+func getTrafficHistory(userName string, period *TrafficPeriod, n int) ([]*TrafficPoint, error) {
+	cmd := fmt.Sprintf("select period,send,receive from %s where username=? order by period desc limit ?", period.Table)
+	rows, err := DB.Query(cmd, userName, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]*TrafficPoint, 0, n)
+	for rows.Next() {
+		point := &TrafficPoint{}
+		if err = rows.Scan(&point.Period, &point.Send, &point.Receive); err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+		points[i], points[j] = points[j], points[i]
+	}
+	return points, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+// connects the dns-over-tcp stream of the client to the resolver of the server
+func (h *Client) serveDNSRelay(stream net.Conn) {
+	resolver := dnsResolver()
+	if resolver == "" {
+		stream.Close()
+		log.Printf("serveDNSRelay no resolver, set dnsserver in config\n")
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", resolver, time.Second*5)
+	if err != nil {
+		stream.Close()
+		log.Printf("serveDNSRelay Dial %s: %+v\n", resolver, err)
+		return
+	}
+
+	record := connTracker.Open(h, "dns://"+resolver)
+	err = nctst.TransferWithCounter(stream, conn,
+		nctst.MultiCounter{&h.receiveCounter, h.receiveSpeed, &record.receiveCounter},
+		nctst.MultiCounter{&h.sendCounter, h.sendSpeed, &record.sendCounter})
+	connTracker.Close(record, closeReason(err))
+}
+
+// dnsserver in config, or the first nameserver of /etc/resolv.conf
+func dnsResolver() string {
+	server := currentConfig().DNSServer
+	if server == "" {
+		server = systemNameServer()
+	}
+	if server == "" {
+		return ""
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+func systemNameServer() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1]
+		}
+	}
+	return ""
+}
@@ -6,7 +6,11 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/PIngBZ/nctst"
@@ -14,10 +18,11 @@ import (
 
 var (
 	configFile string
-	config     *Config
+	// swapped by reloadConfig, read it with currentConfig
+	config atomic.Pointer[Config]
 
 	clients                  = make(map[string]*Client)
-	clientUserNameIndex      = make(map[string]*Client)
+	clientUserNameIndex      = make(map[string]map[string]*Client)
 	clientsLocker            = sync.Mutex{}
 	nextClientID        uint = uint(rand.Intn(89999) + 10000)
 
@@ -35,25 +40,42 @@ func init() {
 		nctst.CheckError(errors.New("no config file"))
 	}
 
-	var err error
-	config, err = parseConfig(configFile)
+	cfg, err := parseConfig(configFile)
 	nctst.CheckError(err)
+	nctst.CheckError(validateConfig(cfg))
+	config.Store(cfg)
 
-	nctst.CommandXorKey = config.Key
+	nctst.CommandXorKey = cfg.Key
+}
+
+func currentConfig() *Config {
+	return config.Load()
 }
 
 func main() {
 	createAminUser()
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp", config.Listen)
+	go rollupDataCountLoop()
+
+	go func() {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		for range hupCh {
+			if _, err := reloadConfig(); err != nil {
+				log.Printf("reloadConfig failed: %+v\n", err)
+			}
+		}
+	}()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", currentConfig().Listen)
 	nctst.CheckError(err)
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	nctst.CheckError(err)
 
 	go func() {
-		for userName := range logoutNotify {
-			doLogout(userName, false)
+		for uuid := range logoutNotify {
+			doLogout(uuid, false)
 		}
 	}()
 
@@ -113,6 +135,8 @@ func onNewConnection(conn *net.TCPConn) {
 		} else {
 			nctst.SendCommand(conn, cmd)
 		}
+	} else if command.Type == nctst.Cmd_testspeed {
+		doTestSpeed(conn, command)
 	} else if command.Type == nctst.Cmd_login {
 		doLogin(conn, command)
 	} else if command.Type == nctst.Cmd_handshake {
@@ -128,7 +152,7 @@ func doLogin(conn *net.TCPConn, command *nctst.Command) {
 
 	cmd := command.Item.(*nctst.CommandLogin)
 
-	if cmd.Key != config.Key {
+	if cmd.Key != currentConfig().Key {
 		log.Println("login error key: " + cmd.Key)
 		return
 	}
@@ -151,40 +175,82 @@ func doLogin(conn *net.TCPConn, command *nctst.Command) {
 		return
 	}
 
-	doLogout(cmd.UserName, true)
-
 	user, _ := UserMgr.GetUser(cmd.UserName)
 
-	client := NewClient(user, cmd.ClientUUID, nextClientID, cmd.Compress, logoutNotify)
+	devices := clientUserNameIndex[cmd.UserName]
+
+	if old, ok := devices[cmd.Device]; ok {
+		doLogout(old.UUID, true)
+	}
+
+	for len(devices) >= UserMgr.DeviceLimit(user) {
+		var oldest *Client
+		for _, c := range devices {
+			if oldest == nil || c.LoginTime.Before(oldest.LoginTime) {
+				oldest = c
+			}
+		}
+		log.Printf("login device limit %s, logout %s %s\n", cmd.UserName, oldest.Device, oldest.UUID)
+		doLogout(oldest.UUID, true)
+	}
+
+	// doLogout removes the map of the user with the last device
+	devices, ok := clientUserNameIndex[cmd.UserName]
+	if !ok {
+		devices = make(map[string]*Client)
+		clientUserNameIndex[cmd.UserName] = devices
+	}
+
+	client := NewClient(user, cmd.ClientUUID, cmd.Device, nextClientID, cmd.Compress, logoutNotify)
 	nextClientID++
 	clients[cmd.ClientUUID] = client
-	clientUserNameIndex[cmd.UserName] = client
+	devices[cmd.Device] = client
 
 	clientsLocker.Unlock()
 
-	var pingUrl string
-	if config.AdminListen[0] == ':' {
-		pingUrl = "http://127.0.0.1" + config.AdminListen
-	} else {
-		pingUrl = "http://" + config.AdminListen
-	}
-	pingUrl += "/ping"
-	sendLoginReply(conn, client.UUID, client.ID, client.ConnKey, pingUrl, nctst.LoginReply_success)
+	sendLoginReply(conn, client.UUID, client.ID, client.ConnKey, currentConfig().PingUrl, nctst.LoginReply_success)
 
-	log.Printf("login success %s %s %d\n", client.UUID, cmd.UserName, client.ID)
+	log.Printf("login success %s %s %s %d\n", client.UUID, cmd.UserName, cmd.Device, client.ID)
 }
 
-func doLogout(userName string, locked bool) {
+func doLogout(uuid string, locked bool) {
 	if !locked {
 		clientsLocker.Lock()
 		defer clientsLocker.Unlock()
 	}
 
-	if client, ok := clientUserNameIndex[userName]; ok {
-		client.Close()
-		delete(clients, client.UUID)
-		delete(clientUserNameIndex, userName)
+	client, ok := clients[uuid]
+	if !ok {
+		return
 	}
+
+	client.Close()
+	delete(clients, uuid)
+
+	if devices, ok := clientUserNameIndex[client.User.UserName]; ok {
+		if devices[client.Device] == client {
+			delete(devices, client.Device)
+		}
+		if len(devices) == 0 {
+			delete(clientUserNameIndex, client.User.UserName)
+		}
+	}
+}
+
+func doKickout(uuid string, reason string) bool {
+	clientsLocker.Lock()
+	client, ok := clients[uuid]
+	clientsLocker.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	client.Kickout(reason)
+	doLogout(client.UUID, false)
+
+	log.Printf("kickout %s %s %s %d: %s\n", client.UUID, client.User.UserName, client.Device, client.ID, reason)
+	return true
 }
 
 func doHandshake(conn *net.TCPConn, command *nctst.Command) {
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/PIngBZ/nctst/proxyclient"
+	"github.com/go-chi/render"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	proxyProbeKeepDays   = 30
+	proxyProbeMaxResults = 1000
+)
+
+func createProxyProbeTable(db *sql.DB) {
+	cmd := `
+		CREATE TABLE IF NOT EXISTS proxyprobe (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username VARCHAR(64),
+			ip VARCHAR(64),
+			version VARCHAR(64),
+			node VARCHAR(300),
+			name VARCHAR(256),
+			ping INTEGER DEFAULT 0,
+			jitter INTEGER DEFAULT 0,
+			throughput INTEGER DEFAULT 0,
+			successrate REAL DEFAULT 0,
+			score REAL DEFAULT 0,
+			probetime TIMESTAMP,
+			savetime TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS proxyprobe_time ON proxyprobe(probetime);
+	`
+	_, err := db.Exec(cmd)
+	nctst.CheckError(err)
+}
+
+// measurements of the proxy list from the clients, sealed like the proxy list
+func (h *UserManager) httpProxyProbe(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	user, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
+
+	buf, err := nctst.ReadLBuf(r.Body)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+	defer buf.Release()
+
+	data, err := proxyclient.OpenProxyList(buf.Data(), proxyclient.ProxyListSecret(currentConfig().Key, user.Hash))
+	if err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
+		return
+	}
+
+	var report *proxyclient.ProxyProbeReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
+		return
+	}
+
+	if len(report.Results) == 0 || len(report.Results) > proxyProbeMaxResults {
+		render.Render(w, r, nctst.ErrInvalidRequest(fmt.Errorf("results count %d", len(report.Results))))
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if err := saveProxyProbe(user.UserName, ip, report); err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, nil)
+}
+
+func saveProxyProbe(userName, ip string, report *proxyclient.ProxyProbeReport) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	cmd := "insert into proxyprobe(username,ip,version,node,name,ping,jitter,throughput,successrate,score,probetime) values(?,?,?,?,?,?,?,?,?,?,?)"
+	for _, result := range report.Results {
+		if _, err := tx.Exec(cmd, userName, ip, report.Version, result.Node, result.Name, result.Ping, result.Jitter,
+			result.Throughput, result.SuccessRate, result.Score, result.Time.UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("delete from proxyprobe where probetime<?", time.Now().UTC().AddDate(0, 0, -proxyProbeKeepDays)); err != nil {
+		log.Printf("saveProxyProbe clean error: %+v\n", err)
+	}
+
+	return tx.Commit()
+}
+
+// reports of the last hours (default 24) per node and office, for the generator
+func (h *UserManager) httpProxyProbeStats(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	r.ParseForm()
+
+	hours := 24
+	if s := r.Form.Get("hours"); s != "" {
+		var err error
+		if hours, err = strconv.Atoi(s); err != nil || hours <= 0 {
+			render.Render(w, r, nctst.ErrInvalidRequest(errors.New("hours error")))
+			return
+		}
+	}
+
+	stats, err := queryProxyProbeStats(time.Now().Add(-time.Hour * time.Duration(hours)))
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, stats)
+}
+
+func queryProxyProbeStats(from time.Time) ([]*proxyclient.ProxyProbeStat, error) {
+	cmd := `select node,username,ip,count(*),avg(case when successrate>0 then ping end),avg(throughput),avg(successrate),max(probetime)
+		from proxyprobe where probetime>=? group by node,username,ip order by node`
+
+	rows, err := DB.Query(cmd, from.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*proxyclient.ProxyProbeStat, 0)
+	for rows.Next() {
+		stat := &proxyclient.ProxyProbeStat{}
+		var ping, throughput sql.NullFloat64
+		var lastTime string
+		if err = rows.Scan(&stat.Node, &stat.UserName, &stat.IP, &stat.Count, &ping, &throughput, &stat.SuccessRate, &lastTime); err != nil {
+			return nil, err
+		}
+		stat.Ping = uint32(ping.Float64)
+		stat.Throughput = uint32(throughput.Float64)
+		stat.LastTime = parseSQLiteTime(lastTime)
+		result = append(result, stat)
+	}
+	return result, nil
+}
+
+// aggregated columns lose the timestamp type and scan as text
+func parseSQLiteTime(s string) time.Time {
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t.Local()
+		}
+	}
+	return time.Time{}
+}
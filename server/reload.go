@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/go-chi/render"
+)
+
+var (
+	reloadLocker sync.Mutex
+)
+
+type ReloadResult struct {
+	Applied     []string `json:"applied"`
+	NeedRestart []string `json:"needrestart"`
+}
+
+func validateConfig(cfg *Config) error {
+	if cfg.Listen == "" {
+		return errors.New("listen is empty")
+	}
+	if cfg.AdminListen == "" {
+		return errors.New("adminlisten is empty")
+	}
+	if cfg.Key == "" {
+		return errors.New("key is empty")
+	}
+	if cfg.AdminPassword == "" {
+		return errors.New("adminpwd is empty")
+	}
+	if cfg.Localnetmask != "" {
+		if _, _, err := net.ParseCIDR(cfg.Localnetmask); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// re-reads the config file and applies the fields which can be changed without
+// dropping sessions, the others keep their running values until restart
+func reloadConfig() (*ReloadResult, error) {
+	reloadLocker.Lock()
+	defer reloadLocker.Unlock()
+
+	cfg, err := parseConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	old := currentConfig()
+	result := &ReloadResult{Applied: []string{}, NeedRestart: []string{}}
+
+	if cfg.Listen != old.Listen {
+		result.NeedRestart = append(result.NeedRestart, "listen")
+		cfg.Listen = old.Listen
+	}
+	if cfg.AdminListen != old.AdminListen {
+		result.NeedRestart = append(result.NeedRestart, "adminlisten")
+		cfg.AdminListen = old.AdminListen
+		cfg.PingUrl = old.PingUrl
+	}
+	if cfg.Key != old.Key {
+		result.NeedRestart = append(result.NeedRestart, "key")
+		cfg.Key = old.Key
+	}
+
+	if cfg.Localnetmask != old.Localnetmask {
+		result.Applied = append(result.Applied, "localnetmask")
+	}
+	if cfg.AdminPassword != old.AdminPassword {
+		result.Applied = append(result.Applied, "adminpwd")
+	}
+	if cfg.MaxDevices != old.MaxDevices {
+		result.Applied = append(result.Applied, "maxdevices")
+	}
+	if cfg.ConnLog != old.ConnLog {
+		result.Applied = append(result.Applied, "connlog")
+	}
+	if cfg.RawRetention != old.RawRetention {
+		result.Applied = append(result.Applied, "rawretentiondays")
+	}
+	if cfg.ReverseHost != old.ReverseHost {
+		result.Applied = append(result.Applied, "reversehost")
+	}
+	if cfg.DNSServer != old.DNSServer {
+		result.Applied = append(result.Applied, "dnsserver")
+	}
+	if cfg.Test != old.Test {
+		result.Applied = append(result.Applied, "test")
+	}
+	if cfg.ProxyListPublicKey != old.ProxyListPublicKey {
+		result.Applied = append(result.Applied, "proxylistpublickey")
+	}
+
+	config.Store(cfg)
+
+	if cfg.AdminPassword != old.AdminPassword {
+		createAminUser()
+	}
+
+	if cfg.Localnetmask != old.Localnetmask {
+		clientsLocker.Lock()
+		for _, client := range clients {
+			client.updateProxyIPNet()
+		}
+		clientsLocker.Unlock()
+	}
+
+	log.Printf("reloadConfig applied: %v, need restart: %v\n", result.Applied, result.NeedRestart)
+	return result, nil
+}
+
+func (h *UserManager) httpReload(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	result, err := reloadConfig()
+	if err != nil {
+		nctst.WriteErrorResponse(w, err.Error())
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, result)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/PIngBZ/nctst"
+)
+
+var (
+	ErrReversePortNotAllowed = errors.New("reverse port not allowed")
+)
+
+// listens on the registered port while the registration stream is open, the
+// accepted connections are carried back to the client in server initiated streams
+func (h *Client) serveReverse(stream net.Conn, port int) {
+	defer stream.Close()
+
+	// read again so the ports changed by the admin apply without relogin
+	user, err := UserMgr.GetUser(h.User.UserName)
+	if err == nil && !reversePortAllowed(user.ReversePorts, port) {
+		err = ErrReversePortNotAllowed
+	}
+
+	var listener net.Listener
+	if err == nil {
+		listener, err = net.Listen("tcp", net.JoinHostPort(currentConfig().ReverseHost, strconv.Itoa(port)))
+	}
+
+	if werr := nctst.WriteReverseResult(stream, err); err != nil || werr != nil {
+		if listener != nil {
+			listener.Close()
+		}
+		log.Printf("serveReverse %s %d: %+v %+v\n", h.User.UserName, port, err, werr)
+		return
+	}
+
+	log.Printf("serveReverse %s %s listening %s\n", h.User.UserName, h.Device, listener.Addr().String())
+
+	go h.reverseAcceptLoop(listener, port)
+
+	// the client keeps the stream open, it is closed with the session too
+	io.Copy(io.Discard, stream)
+	listener.Close()
+
+	log.Printf("serveReverse %s %s closed %s\n", h.User.UserName, h.Device, listener.Addr().String())
+}
+
+func (h *Client) reverseAcceptLoop(listener net.Listener, port int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go h.reverseTransfer(conn, port)
+	}
+}
+
+func (h *Client) reverseTransfer(conn net.Conn, port int) {
+	stream, err := h.smux.OpenStream()
+	if err != nil {
+		conn.Close()
+		log.Printf("reverseTransfer OpenStream: %+v\n", err)
+		return
+	}
+
+	if err = nctst.WriteReverseHeader(stream, port, conn.RemoteAddr().String()); err != nil {
+		conn.Close()
+		stream.Close()
+		log.Printf("reverseTransfer WriteReverseHeader: %+v\n", err)
+		return
+	}
+
+	record := connTracker.Open(h, fmt.Sprintf("reverse://%s->:%d", conn.RemoteAddr().String(), port))
+	err = nctst.TransferWithCounter(stream, conn,
+		nctst.MultiCounter{&h.receiveCounter, h.receiveSpeed, &record.receiveCounter},
+		nctst.MultiCounter{&h.sendCounter, h.sendSpeed, &record.sendCounter})
+	connTracker.Close(record, closeReason(err))
+}
+
+// ports like "9100-9110,9200", empty allows nothing
+func parsePortRanges(s string) ([]nctst.Pair[int, int], error) {
+	ranges := make([]nctst.Pair[int, int], 0)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		from, to, found := strings.Cut(item, "-")
+		start, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("error port %s", item)
+		}
+		end := start
+		if found {
+			if end, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+				return nil, fmt.Errorf("error port %s", item)
+			}
+		}
+		if start <= 0 || end > 65535 || start > end {
+			return nil, fmt.Errorf("error port %s", item)
+		}
+		ranges = append(ranges, nctst.Pair[int, int]{First: start, Second: end})
+	}
+	return ranges, nil
+}
+
+func reversePortAllowed(ports string, port int) bool {
+	ranges, err := parsePortRanges(ports)
+	if err != nil {
+		log.Printf("reversePortAllowed parsePortRanges: %+v\n", err)
+		return false
+	}
+
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Second {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type TunnelSessionInfo struct {
+	ID           uint  `json:"id"`
+	ConnNum      int   `json:"connnum"`
+	Ping         int64 `json:"ping"`
+	ReceiveSpeed int64 `json:"receivespeed"`
+	SendSpeed    int64 `json:"sendspeed"`
+}
+
+func (h *TunnelSessionInfo) FormatReceiveSpeed() string {
+	return humanize.Bytes(uint64(h.ReceiveSpeed)) + "/s"
+}
+
+func (h *TunnelSessionInfo) FormatSendSpeed() string {
+	return humanize.Bytes(uint64(h.SendSpeed)) + "/s"
+}
+
+type SessionInfo struct {
+	UserName     string               `json:"username"`
+	Device       string               `json:"device"`
+	ClientID     uint                 `json:"clientid"`
+	UUID         string               `json:"uuid"`
+	LoginTime    time.Time            `json:"logintime"`
+	ReceiveSpeed int64                `json:"receivespeed"`
+	SendSpeed    int64                `json:"sendspeed"`
+	Tunnels      []*TunnelSessionInfo `json:"tunnels"`
+}
+
+func (h *SessionInfo) FormatReceiveSpeed() string {
+	return humanize.Bytes(uint64(h.ReceiveSpeed)) + "/s"
+}
+
+func (h *SessionInfo) FormatSendSpeed() string {
+	return humanize.Bytes(uint64(h.SendSpeed)) + "/s"
+}
+
+type ListConnectionsRenderData struct {
+	Filter *ConnFilter
+	List   []*ConnRecord
+}
+
+func getSessions() []*SessionInfo {
+	clientsLocker.Lock()
+	list := make([]*Client, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, client)
+	}
+	clientsLocker.Unlock()
+
+	sessions := make([]*SessionInfo, 0, len(list))
+	for _, client := range list {
+		session := &SessionInfo{}
+		session.UserName = client.User.UserName
+		session.Device = client.Device
+		session.ClientID = client.ID
+		session.UUID = client.UUID
+		session.LoginTime = client.LoginTime
+		session.ReceiveSpeed = client.receiveSpeed.Speed()
+		session.SendSpeed = client.sendSpeed.Speed()
+
+		tunnels := client.Tunnels()
+		session.Tunnels = make([]*TunnelSessionInfo, 0, len(tunnels))
+		for _, tunnel := range tunnels {
+			info := &TunnelSessionInfo{}
+			info.ID = tunnel.ID
+			info.ConnNum = tunnel.ConnNum()
+			info.Ping = tunnel.Ping
+			info.ReceiveSpeed = tunnel.ReceiveSpeed.Speed()
+			info.SendSpeed = tunnel.SendSpeed.Speed()
+			session.Tunnels = append(session.Tunnels, info)
+		}
+		sort.Slice(session.Tunnels, func(i, j int) bool {
+			return session.Tunnels[i].ID < session.Tunnels[j].ID
+		})
+
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].UserName != sessions[j].UserName {
+			return sessions[i].UserName < sessions[j].UserName
+		}
+		return sessions[i].LoginTime.Before(sessions[j].LoginTime)
+	})
+	return sessions
+}
+
+func (h *UserManager) listSessions(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	t, err := template.ParseFiles("html/listsessions.html")
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	err = t.Execute(w, getSessions())
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+}
+
+func (h *UserManager) httpSessions(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, getSessions())
+}
+
+func (h *UserManager) kickSession(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	r.ParseForm()
+	reason := r.Form.Get("reason")
+	if reason == "" {
+		reason = "disconnected by administrator"
+	}
+
+	if !doKickout(chi.URLParam(r, "uuid"), reason) {
+		render.Render(w, r, nctst.ErrNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+func connFilterFromRequest(r *http.Request) *ConnFilter {
+	r.ParseForm()
+	filter := &ConnFilter{}
+	filter.UserName = r.Form.Get("user")
+	filter.Target = r.Form.Get("target")
+	filter.Active = r.Form.Get("active") == "1"
+	return filter
+}
+
+func (h *UserManager) listConnections(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	t, err := template.ParseFiles("html/listconnections.html")
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	filter := connFilterFromRequest(r)
+	err = t.Execute(w, &ListConnectionsRenderData{Filter: filter, List: connTracker.Query(filter)})
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+}
+
+func (h *UserManager) httpConnections(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, connTracker.Query(connFilterFromRequest(r)))
+}
+
+func (h *UserManager) httpConnHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	if !currentConfig().ConnLog {
+		render.Render(w, r, nctst.ErrInvalidRequest(errors.New("connlog is disabled")))
+		return
+	}
+
+	filter := connFilterFromRequest(r)
+
+	parseTime := func(key string, def time.Time) (time.Time, error) {
+		s := r.Form.Get(key)
+		if s == "" {
+			return def, nil
+		}
+		return time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	}
+
+	from, err := parseTime("from", time.Now().Add(-time.Hour*24))
+	if err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
+		return
+	}
+	to, err := parseTime("to", time.Now())
+	if err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
+		return
+	}
+
+	limit := 500
+	if s := r.Form.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			render.Render(w, r, nctst.ErrInvalidRequest(errors.New("error limit")))
+			return
+		}
+	}
+
+	records, err := queryConnHistory(filter, from, to, limit)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, records)
+}
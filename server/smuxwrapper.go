@@ -1,29 +1,152 @@
 package main
 
 import (
+	"bytes"
+	"io"
+	"log"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/PIngBZ/nctst"
 	"github.com/xtaci/smux"
 )
 
+// splits the accepted streams into socks5 connections returned by Accept, udp
+// relay streams passed to udpHandler, reverse registrations passed to
+// reverseHandler and dns-over-tcp streams passed to dnsHandler
 type SmuxWrapper struct {
-	session *smux.Session
+	session        *smux.Session
+	udpHandler     func(stream net.Conn, target string)
+	reverseHandler func(stream net.Conn, port int)
+	dnsHandler     func(stream net.Conn)
+
+	conns   chan net.Conn
+	err     error
+	die     chan struct{}
+	dieOnce sync.Once
 }
 
-func NewSmuxWrapper(session *smux.Session) *SmuxWrapper {
+func NewSmuxWrapper(session *smux.Session, udpHandler func(stream net.Conn, target string), reverseHandler func(stream net.Conn, port int), dnsHandler func(stream net.Conn)) *SmuxWrapper {
 	h := &SmuxWrapper{}
 	h.session = session
+	h.udpHandler = udpHandler
+	h.reverseHandler = reverseHandler
+	h.dnsHandler = dnsHandler
+	h.conns = make(chan net.Conn)
+	h.die = make(chan struct{})
+
+	go h.acceptLoop()
 	return h
 }
 
+func (h *SmuxWrapper) acceptLoop() {
+	for {
+		stream, err := h.session.AcceptStream()
+		if err != nil {
+			h.err = err
+			h.Close()
+			return
+		}
+
+		go h.classify(stream)
+	}
+}
+
+func (h *SmuxWrapper) classify(stream *smux.Stream) {
+	stream.SetReadDeadline(time.Now().Add(time.Second * 10))
+
+	var first [1]byte
+	if _, err := io.ReadFull(stream, first[:]); err != nil {
+		stream.Close()
+		return
+	}
+
+	// socks4/5 handshakes start with the version
+	if first[0] == 0 {
+		h.dispatch(stream, io.MultiReader(bytes.NewReader(first[:]), stream))
+		return
+	}
+
+	stream.SetReadDeadline(time.Time{})
+
+	conn := NewHandshakeRecordConn(&prefixConn{Conn: stream, prefix: first[:]})
+	select {
+	case h.conns <- conn:
+	case <-h.die:
+		stream.Close()
+	}
+}
+
+func (h *SmuxWrapper) dispatch(stream *smux.Stream, reader io.Reader) {
+	key, err := nctst.ReadUInt(reader)
+	if err != nil {
+		stream.Close()
+		return
+	}
+
+	switch key {
+	case nctst.UDP_RELAY_KEY:
+		target, err := nctst.ReadLString(reader)
+		if err != nil {
+			stream.Close()
+			log.Printf("SmuxWrapper read udp relay target: %+v\n", err)
+			return
+		}
+		stream.SetReadDeadline(time.Time{})
+		h.udpHandler(stream, target)
+	case nctst.REVERSE_KEY:
+		port, err := nctst.ReadUInt(reader)
+		if err != nil {
+			stream.Close()
+			log.Printf("SmuxWrapper read reverse port: %+v\n", err)
+			return
+		}
+		stream.SetReadDeadline(time.Time{})
+		h.reverseHandler(stream, int(port))
+	case nctst.DNS_RELAY_KEY:
+		stream.SetReadDeadline(time.Time{})
+		h.dnsHandler(stream)
+	default:
+		stream.Close()
+		log.Printf("SmuxWrapper dispatch: %+v %X\n", nctst.ErrStreamKey, key)
+	}
+}
+
 func (h *SmuxWrapper) Accept() (net.Conn, error) {
-	return h.session.AcceptStream()
+	select {
+	case conn := <-h.conns:
+		return conn, nil
+	case <-h.die:
+		if h.err != nil {
+			return nil, h.err
+		}
+		return nil, io.ErrClosedPipe
+	}
 }
 
 func (h *SmuxWrapper) Close() error {
+	h.dieOnce.Do(func() {
+		close(h.die)
+	})
 	return h.session.Close()
 }
 
 func (h *SmuxWrapper) Addr() net.Addr {
 	return h.session.LocalAddr()
 }
+
+// gives back the bytes read while classifying the stream
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (h *prefixConn) Read(p []byte) (int, error) {
+	if len(h.prefix) > 0 {
+		n := copy(p, h.prefix)
+		h.prefix = h.prefix[n:]
+		return n, nil
+	}
+	return h.Conn.Read(p)
+}
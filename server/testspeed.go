@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+const (
+	testSpeedMaxUpload   = nctst.TEST_SPEED_MAX_SIZE / 4
+	testSpeedMaxRunning  = 16
+	testSpeedIPRunning   = 2
+	testSpeedIPPerMinute = 30
+)
+
+type testSpeedLimit struct {
+	running int
+	window  time.Time
+	count   int
+}
+
+var (
+	testSpeedLimits  = make(map[string]*testSpeedLimit)
+	testSpeedRunning int
+	testSpeedLocker  sync.Mutex
+)
+
+// the speed test needs no login, so the tests are limited per source ip and in total
+func acquireTestSpeed(ip string) bool {
+	testSpeedLocker.Lock()
+	defer testSpeedLocker.Unlock()
+
+	now := time.Now()
+	if len(testSpeedLimits) > 1024 {
+		for k, v := range testSpeedLimits {
+			if v.running == 0 && now.Sub(v.window) > time.Minute {
+				delete(testSpeedLimits, k)
+			}
+		}
+	}
+
+	limit, ok := testSpeedLimits[ip]
+	if !ok {
+		limit = &testSpeedLimit{window: now}
+		testSpeedLimits[ip] = limit
+	}
+	if now.Sub(limit.window) > time.Minute {
+		limit.window, limit.count = now, 0
+	}
+
+	if testSpeedRunning >= testSpeedMaxRunning || limit.running >= testSpeedIPRunning || limit.count >= testSpeedIPPerMinute {
+		return false
+	}
+
+	testSpeedRunning++
+	limit.running++
+	limit.count++
+	return true
+}
+
+func releaseTestSpeed(ip string) {
+	testSpeedLocker.Lock()
+	defer testSpeedLocker.Unlock()
+
+	testSpeedRunning--
+	if limit, ok := testSpeedLimits[ip]; ok {
+		limit.running--
+	}
+}
+
+func doTestSpeed(conn *net.TCPConn, command *nctst.Command) {
+	defer conn.Close()
+
+	cmd := command.Item.(*nctst.CommandTestSpeed)
+	if cmd.Upload < 0 || cmd.Upload > testSpeedMaxUpload || cmd.Download < 0 || cmd.Download > nctst.TEST_SPEED_MAX_SIZE {
+		log.Printf("doTestSpeed size error %d %d\n", cmd.Upload, cmd.Download)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	if !acquireTestSpeed(ip) {
+		log.Printf("doTestSpeed limited %s\n", ip)
+		replyTestSpeedBusy(conn, cmd)
+		return
+	}
+	defer releaseTestSpeed(ip)
+
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+
+	if _, err := io.CopyN(io.Discard, conn, int64(cmd.Upload)); err != nil {
+		return
+	}
+
+	if err := nctst.SendCommand(conn, command); err != nil {
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	rand.Read(buf)
+	for left := cmd.Download; left > 0; {
+		n, err := conn.Write(buf[:nctst.Min(left, len(buf))])
+		if err != nil {
+			return
+		}
+		left -= n
+	}
+
+	// let the client read to the end
+	conn.CloseWrite()
+	io.Copy(io.Discard, conn)
+}
+
+// zero sizes tell the client the server is busy, not a server without the speed test,
+// the upload is read first so the client gets to the reply
+func replyTestSpeedBusy(conn *net.TCPConn, cmd *nctst.CommandTestSpeed) {
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	if _, err := io.CopyN(io.Discard, conn, int64(cmd.Upload)); err != nil {
+		return
+	}
+
+	nctst.SendCommand(conn, &nctst.Command{Type: nctst.Cmd_testspeed, Item: &nctst.CommandTestSpeed{}})
+	conn.CloseWrite()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/PIngBZ/nctst"
+)
+
+const (
+	udpRelayIdleTimeout = time.Minute * 2
+)
+
+// forwards the datagrams of one client side udp peer to the target
+func (h *Client) serveUDPRelay(stream net.Conn, target string) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		stream.Close()
+		log.Printf("serveUDPRelay ResolveUDPAddr %s: %+v\n", target, err)
+		return
+	}
+
+	if ipNet := h.proxyIPNet.Load(); ipNet != nil && !ipNet.Contains(addr.IP) {
+		stream.Close()
+		log.Printf("serveUDPRelay %s not allowed for %s\n", target, h.User.UserName)
+		return
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		stream.Close()
+		log.Printf("serveUDPRelay DialUDP %s: %+v\n", target, err)
+		return
+	}
+
+	record := connTracker.Open(h, "udp://"+target)
+	receive := nctst.MultiCounter{&h.receiveCounter, h.receiveSpeed, &record.receiveCounter}
+	send := nctst.MultiCounter{&h.sendCounter, h.sendSpeed, &record.sendCounter}
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	errCh := make(chan error, 2)
+
+	go func() {
+		buf := make([]byte, nctst.UDP_PACKET_SIZE)
+		for {
+			n, err := nctst.ReadUDPPacket(stream, buf)
+			if err != nil {
+				errCh <- nctst.ErrTransferFirstClosed
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if _, err = conn.Write(buf[:n]); err != nil {
+				errCh <- err
+				return
+			}
+			send.Add(int64(n))
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, nctst.UDP_PACKET_SIZE)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpRelayIdleTimeout))
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					if time.Since(time.Unix(0, lastActive.Load())) < udpRelayIdleTimeout {
+						continue
+					}
+					errCh <- errors.New("idle timeout")
+					return
+				}
+				errCh <- err
+				return
+			}
+			lastActive.Store(time.Now().UnixNano())
+			if err = nctst.WriteUDPPacket(stream, buf[:n]); err != nil {
+				errCh <- nctst.ErrTransferFirstClosed
+				return
+			}
+			receive.Add(int64(n))
+		}
+	}()
+
+	err = <-errCh
+	stream.Close()
+	conn.Close()
+	connTracker.Close(record, closeReason(err))
+}
@@ -46,6 +46,11 @@ type UserInfo struct {
 	CodeInfo    *CodeInfo
 	Proxy       bool
 	NoCodeLogin bool
+	MaxDevices  int
+	Online      int
+
+	// server ports the client may register for reverse forwarding, like "9100-9110,9200"
+	ReversePorts string
 
 	TrafficHour  TrafficCountInfo
 	TrafficDay   TrafficCountInfo
@@ -76,7 +81,7 @@ func (h *UserManager) CheckUserPassword(username, hash string) bool {
 }
 
 func (h *UserManager) CheckAuthCode(username string, code int) bool {
-	if config.Test {
+	if currentConfig().Test {
 		return true
 	}
 
@@ -95,6 +100,13 @@ func (h *UserManager) CheckAuthCode(username string, code int) bool {
 	return false
 }
 
+func (h *UserManager) DeviceLimit(user *UserInfo) int {
+	if user.MaxDevices > 0 {
+		return user.MaxDevices
+	}
+	return currentConfig().MaxDevices
+}
+
 func (h *UserManager) SaveCount(user *UserInfo, send, receive int64) {
 	_, err := DB.Exec("insert into datacount(username,send,receive) values(?,?,?)", user.UserName, send, receive)
 	if err != nil {
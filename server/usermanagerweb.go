@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -24,9 +26,15 @@ import (
 var (
 	LoginUserContextKey  = &nctst.ContextKey{Key: "login_user_context_key"}
 	TargetUserContextKey = &nctst.ContextKey{Key: "user_context_key"}
-	proxyGroupsData      []byte
+	// replaced by the publisher, loaded once per request
+	currentProxyGroups atomic.Pointer[proxyGroupsData]
 )
 
+type proxyGroupsData struct {
+	data   []byte
+	signed bool
+}
+
 func init() {
 	loadProxyGroupData()
 	go UserMgr.daemon()
@@ -48,8 +56,11 @@ func (h *UserManager) daemon() {
 	r.Get("/checkcode", h.httpCheckAuthCode)
 	r.Post("/updateProxylist", h.httpUpadteProxyList)
 	r.Get("/proxylist", h.httpProxyList)
+	r.Post("/proxyprobe", h.httpProxyProbe)
+	r.Get("/proxyprobe/stats", h.httpProxyProbeStats)
 	r.Get("/exit", h.httpExit)
 	r.Get("/ping", h.httpPing)
+	r.Get("/reload", h.httpReload)
 
 	r.Route("/users", func(r chi.Router) {
 		r.Get("/", h.listUsers)
@@ -64,10 +75,26 @@ func (h *UserManager) daemon() {
 			r.Post("/commitpwd", h.commitPwd)
 			r.Get("/proxy", h.changeProxy)
 			r.Get("/nocodelogin", h.noCodeLogin)
+			r.Get("/maxdevices", h.changeMaxDevices)
+			r.Get("/reverseports", h.changeReversePorts)
+			r.Get("/history", h.trafficHistory)
+			r.Get("/traffic", h.httpTrafficHistory)
 		})
 	})
 
-	http.ListenAndServe(config.AdminListen, r)
+	r.Route("/sessions", func(r chi.Router) {
+		r.Get("/", h.listSessions)
+		r.Get("/data", h.httpSessions)
+		r.Get("/{uuid}/kick", h.kickSession)
+	})
+
+	r.Route("/connections", func(r chi.Router) {
+		r.Get("/", h.listConnections)
+		r.Get("/data", h.httpConnections)
+		r.Get("/history", h.httpConnHistory)
+	})
+
+	http.ListenAndServe(currentConfig().AdminListen, r)
 }
 
 func (h *UserManager) basicAuth(next http.Handler) http.Handler {
@@ -129,11 +156,11 @@ func (h *UserManager) targetUserCtx(next http.Handler) http.Handler {
 }
 
 func (h *UserManager) GetUser(username string) (*UserInfo, error) {
-	var id, realName, hash, session string
-	var admin, status, proxy, noCodeLogin int
+	var id, realName, hash, session, reversePorts string
+	var admin, status, proxy, noCodeLogin, maxDevices int
 	var lastTime, createTime time.Time
-	cmd := "select id,realname,password,admin,session,lasttime,createtime,status,proxy,nocodelogin from userinfo where username=?"
-	if err := DB.QueryRow(cmd, username).Scan(&id, &realName, &hash, &admin, &session, &lastTime, &createTime, &status, &proxy, &noCodeLogin); err != nil {
+	cmd := "select id,realname,password,admin,session,lasttime,createtime,status,proxy,nocodelogin,maxdevices,reverseports from userinfo where username=?"
+	if err := DB.QueryRow(cmd, username).Scan(&id, &realName, &hash, &admin, &session, &lastTime, &createTime, &status, &proxy, &noCodeLogin, &maxDevices, &reversePorts); err != nil {
 		return nil, err
 	}
 	user := &UserInfo{}
@@ -148,6 +175,8 @@ func (h *UserManager) GetUser(username string) (*UserInfo, error) {
 	user.Status = UserStatus(status)
 	user.Proxy = proxy == 1
 	user.NoCodeLogin = noCodeLogin == 1
+	user.MaxDevices = maxDevices
+	user.ReversePorts = reversePorts
 
 	if c, loaded := h.authCodes.Load(username); loaded {
 		user.CodeInfo = c.(*CodeInfo)
@@ -165,15 +194,19 @@ type ListUserRenderData struct {
 }
 
 func (h *UserManager) getDataCounts(t int) (map[string]nctst.Pair[uint64, uint64], error) {
-	w := "%Y-%m-%d-%H" // hour
+	where := "period=strftime('" + TrafficPeriodHour.Format + "','now')" // hour
+	table := TrafficPeriodHour.Table
 	if t == 1 {
-		w = "%Y-%m-%d)" // day
+		where = "period=strftime('" + TrafficPeriodDay.Format + "','now')" // day
+		table = TrafficPeriodDay.Table
 	} else if t == 2 {
-		w = "%Y-%W" // week
+		where = "strftime('%Y-%W',period)=strftime('%Y-%W','now')" // week
+		table = TrafficPeriodDay.Table
 	} else if t == 3 {
-		w = "%Y-%m" // month
+		where = "period=strftime('" + TrafficPeriodMonth.Format + "','now')" // month
+		table = TrafficPeriodMonth.Table
 	}
-	rows, err := DB.Query("select username,sum(send),sum(receive) from datacount where strftime('" + w + "',savetime)=strftime('" + w + "','now') group by username")
+	rows, err := DB.Query("select username,sum(send),sum(receive) from " + table + " where " + where + " group by username")
 	if err != nil {
 		return nil, err
 	}
@@ -195,6 +228,10 @@ func (h *UserManager) getDataCounts(t int) (map[string]nctst.Pair[uint64, uint64
 func (h *UserManager) listUsers(w http.ResponseWriter, r *http.Request) {
 	login, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
 
+	if err := rollupDataCount(); err != nil {
+		log.Printf("listUsers rollupDataCount error: %+v\n", err)
+	}
+
 	hourCounts, err := h.getDataCounts(0)
 	if err != nil {
 		hourCounts = make(map[string]nctst.Pair[uint64, uint64])
@@ -212,11 +249,11 @@ func (h *UserManager) listUsers(w http.ResponseWriter, r *http.Request) {
 		monthCounts = make(map[string]nctst.Pair[uint64, uint64])
 	}
 
-	var id, userName, realName, hash string
-	var admin, status, proxy, noCodeLogin int
+	var id, userName, realName, hash, reversePorts string
+	var admin, status, proxy, noCodeLogin, maxDevices int
 	var lastTime, createTime time.Time
 
-	cmd := "select id,username,realname,password,admin,lasttime,createtime,status,proxy,nocodelogin from userinfo"
+	cmd := "select id,username,realname,password,admin,lasttime,createtime,status,proxy,nocodelogin,maxdevices,reverseports from userinfo"
 	if !login.Admin {
 		cmd += " where id=" + login.ID
 	} else {
@@ -230,9 +267,16 @@ func (h *UserManager) listUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
+	online := make(map[string]int)
+	clientsLocker.Lock()
+	for userName, devices := range clientUserNameIndex {
+		online[userName] = len(devices)
+	}
+	clientsLocker.Unlock()
+
 	users := make([]*UserInfo, 0)
 	for rows.Next() {
-		if err = rows.Scan(&id, &userName, &realName, &hash, &admin, &lastTime, &createTime, &status, &proxy, &noCodeLogin); err != nil {
+		if err = rows.Scan(&id, &userName, &realName, &hash, &admin, &lastTime, &createTime, &status, &proxy, &noCodeLogin, &maxDevices, &reversePorts); err != nil {
 			render.Render(w, r, nctst.ErrInternal(err))
 			return
 		}
@@ -247,6 +291,9 @@ func (h *UserManager) listUsers(w http.ResponseWriter, r *http.Request) {
 		user.Status = UserStatus(status)
 		user.Proxy = proxy == 1
 		user.NoCodeLogin = noCodeLogin == 1
+		user.MaxDevices = maxDevices
+		user.ReversePorts = reversePorts
+		user.Online = online[userName]
 
 		if dc, ok := hourCounts[userName]; ok {
 			user.TrafficHour.Send = dc.First
@@ -489,6 +536,109 @@ func (h *UserManager) noCodeLogin(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/users", http.StatusFound)
 }
 
+func (h *UserManager) changeMaxDevices(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	user, _ := r.Context().Value(TargetUserContextKey).(*UserInfo)
+
+	r.ParseForm()
+	n, err := strconv.Atoi(r.Form.Get("n"))
+	if err != nil || n < 0 {
+		render.Render(w, r, nctst.ErrInvalidRequest(errors.New("error params")))
+		return
+	}
+
+	_, err = DB.Exec("update userinfo set maxdevices=? where id=?", n, user.ID)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+func (h *UserManager) changeReversePorts(w http.ResponseWriter, r *http.Request) {
+	if !h.isAdmin(r) {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	user, _ := r.Context().Value(TargetUserContextKey).(*UserInfo)
+
+	r.ParseForm()
+	ports := strings.ReplaceAll(r.Form.Get("p"), " ", "")
+	if _, err := parsePortRanges(ports); err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
+		return
+	}
+
+	_, err := DB.Exec("update userinfo set reverseports=? where id=?", ports, user.ID)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	http.Redirect(w, r, "/users", http.StatusFound)
+}
+
+func (h *UserManager) trafficHistory(w http.ResponseWriter, r *http.Request) {
+	login, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
+	target, _ := r.Context().Value(TargetUserContextKey).(*UserInfo)
+
+	if !h.isAdmin(r) && login.ID != target.ID {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	t, err := template.ParseFiles("html/traffichistory.html")
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	err = t.Execute(w, target)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+}
+
+func (h *UserManager) httpTrafficHistory(w http.ResponseWriter, r *http.Request) {
+	login, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
+	target, _ := r.Context().Value(TargetUserContextKey).(*UserInfo)
+
+	if !h.isAdmin(r) && login.ID != target.ID {
+		render.Render(w, r, nctst.ErrForbiddenNeedAdmin)
+		return
+	}
+
+	r.ParseForm()
+	period, ok := trafficPeriods[r.Form.Get("period")]
+	if !ok {
+		period = TrafficPeriodHour
+	}
+
+	n, err := strconv.Atoi(r.Form.Get("n"))
+	if err != nil || n <= 0 || n > 1000 {
+		n = 48
+	}
+
+	if err := rollupDataCount(); err != nil {
+		log.Printf("httpTrafficHistory rollupDataCount error: %+v\n", err)
+	}
+
+	points, err := getTrafficHistory(target.UserName, period, n)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInternal(err))
+		return
+	}
+
+	nctst.WriteSuccessResponse(w, points)
+}
+
 func (h *UserManager) httpGenerateAuthCode(w http.ResponseWriter, r *http.Request) {
 	user, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
 
@@ -596,36 +746,59 @@ func (h *UserManager) httpUpadteProxyList(w http.ResponseWriter, r *http.Request
 		render.Render(w, r, nctst.ErrInternal(err))
 		return
 	}
+	defer buf.Release()
 
-	nctst.Xor(buf.Data(), []byte(user.UserName))
-	nctst.Xor(buf.Data(), []byte(config.Key))
-
-	var proxyGroups *proxyclient.ProxyGroups
-	if err := json.Unmarshal(buf.Data(), &proxyGroups); err != nil {
+	data, err := proxyclient.OpenProxyList(buf.Data(), proxyclient.ProxyListSecret(currentConfig().Key, user.Hash))
+	if err != nil {
 		render.Render(w, r, nctst.ErrInvalidRequest(err))
 		return
 	}
 
-	if len(proxyGroups.Groups) == 0 {
-		render.Render(w, r, nctst.ErrInvalidRequest(errors.New("no group")))
+	signed, err := parseProxyGroupsData(data)
+	if err != nil {
+		render.Render(w, r, nctst.ErrInvalidRequest(err))
 		return
 	}
-
-	for _, group := range proxyGroups.Groups {
-		if len(group.List) == 0 {
-			render.Render(w, r, nctst.ErrInvalidRequest(fmt.Errorf("empty list of group %s", group.Name)))
-			return
-		}
+	if !signed {
+		render.Render(w, r, nctst.ErrInvalidRequest(proxyclient.ErrProxyListNotSigned))
+		return
 	}
 
-	proxyGroupsData = buf.Data()
+	currentProxyGroups.Store(&proxyGroupsData{data: data, signed: true})
 
-	os.WriteFile("proxydata/current.json", proxyGroupsData, 0600)
-	os.WriteFile(fmt.Sprintf("proxydata/%s.json", time.Now().Format("20060102150405")), proxyGroupsData, 0600)
+	os.WriteFile("proxydata/current.json", data, 0600)
+	os.WriteFile(fmt.Sprintf("proxydata/%s.json", time.Now().Format("20060102150405")), data, 0600)
 
 	nctst.WriteSuccessResponse(w, nil)
 }
 
+// the signed list of the publisher, or a plain list saved by the old versions
+func parseProxyGroupsData(data []byte) (bool, error) {
+	signed := true
+	groupsData, err := proxyclient.VerifyProxyList(data, currentConfig().ProxyListKey)
+	if err == proxyclient.ErrProxyListNotSigned {
+		signed, groupsData = false, data
+	} else if err != nil {
+		return false, err
+	}
+
+	var proxyGroups *proxyclient.ProxyGroups
+	if err := json.Unmarshal(groupsData, &proxyGroups); err != nil {
+		return false, err
+	}
+
+	if proxyGroups == nil || len(proxyGroups.Groups) == 0 {
+		return false, errors.New("no group")
+	}
+
+	for _, group := range proxyGroups.Groups {
+		if len(group.List) == 0 {
+			return false, fmt.Errorf("empty list of group %s", group.Name)
+		}
+	}
+	return signed, nil
+}
+
 func loadProxyGroupData() {
 	data, err := os.ReadFile("proxydata/current.json")
 	if err != nil {
@@ -633,34 +806,43 @@ func loadProxyGroupData() {
 		return
 	}
 
-	var proxyGroups *proxyclient.ProxyGroups
-	if err := json.Unmarshal(data, &proxyGroups); err != nil {
+	signed, err := parseProxyGroupsData(data)
+	if err != nil {
 		log.Printf("loadProxyGroupData decode failed %+v\n", err)
 		return
 	}
 
-	if len(proxyGroups.Groups) == 0 {
-		log.Printf("loadProxyGroupData no group, %s\n", string(data))
-		return
-	}
-
-	proxyGroupsData = data
+	currentProxyGroups.Store(&proxyGroupsData{data: data, signed: signed})
 
-	log.Println("loadProxyGroupData success")
+	log.Printf("loadProxyGroupData success, signed %t\n", signed)
 }
 
+// the signed list is encrypted with the key and the password hash of the user,
+// the old plain list is still xored for the old clients until the next publish
 func (h *UserManager) httpProxyList(w http.ResponseWriter, r *http.Request) {
 	user, _ := r.Context().Value(LoginUserContextKey).(*UserInfo)
 
-	if len(proxyGroupsData) == 0 {
+	current := currentProxyGroups.Load()
+	if current == nil {
 		render.Render(w, r, nctst.ErrNotFound)
 		return
 	}
 
+	if current.signed {
+		data, err := proxyclient.SealProxyList(current.data, proxyclient.ProxyListSecret(currentConfig().Key, user.Hash))
+		if err != nil {
+			render.Render(w, r, nctst.ErrInternal(err))
+			return
+		}
+		w.Write(data)
+		return
+	}
+
 	buf := nctst.DataBufPool.Get()
-	nctst.WriteData(buf, proxyGroupsData)
+	defer buf.Release()
+	nctst.WriteData(buf, current.data)
 
-	nctst.Xor(buf.Data()[4:], []byte(config.Key))
+	nctst.Xor(buf.Data()[4:], []byte(currentConfig().Key))
 	nctst.Xor(buf.Data()[4:], []byte(user.UserName))
 
 	w.Write(buf.Data())
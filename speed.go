@@ -0,0 +1,66 @@
+package nctst
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Counter interface {
+	Add(delta int64) int64
+}
+
+type MultiCounter []Counter
+
+func (h MultiCounter) Add(delta int64) (n int64) {
+	for _, c := range h {
+		if c != nil {
+			n = c.Add(delta)
+		}
+	}
+	return
+}
+
+type SpeedCounter struct {
+	total atomic.Int64
+	speed atomic.Int64
+
+	lastTotal int64
+	lastTime  time.Time
+	locker    sync.Mutex
+}
+
+func NewSpeedCounter() *SpeedCounter {
+	h := &SpeedCounter{}
+	h.lastTime = time.Now()
+	return h
+}
+
+func (h *SpeedCounter) Add(delta int64) int64 {
+	return h.total.Add(delta)
+}
+
+func (h *SpeedCounter) Total() int64 {
+	return h.total.Load()
+}
+
+// bytes per second between the last two samples
+func (h *SpeedCounter) Speed() int64 {
+	return h.speed.Load()
+}
+
+func (h *SpeedCounter) Sample() {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(h.lastTime)
+	if elapsed < time.Millisecond*100 {
+		return
+	}
+
+	total := h.total.Load()
+	h.speed.Store((total - h.lastTotal) * int64(time.Second) / int64(elapsed))
+	h.lastTotal = total
+	h.lastTime = now
+}
@@ -0,0 +1,38 @@
+package nctst
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrStreamKey     = errors.New("stream key error")
+	ErrUDPPacketSize = errors.New("udp packet size error")
+)
+
+// a udp relay stream starts with the key and the target address, then carries
+// length prefixed datagrams in both directions
+func WriteUDPRelayHeader(writer io.Writer, target string) error {
+	if err := WriteUInt(writer, UDP_RELAY_KEY); err != nil {
+		return err
+	}
+	return WriteLString(writer, target)
+}
+
+func WriteUDPPacket(writer io.Writer, data []byte) error {
+	if len(data) > UDP_PACKET_SIZE {
+		return ErrUDPPacketSize
+	}
+	return WriteLData(writer, data)
+}
+
+func ReadUDPPacket(reader io.Reader, buf []byte) (int, error) {
+	l, err := ReadUInt(reader)
+	if err != nil {
+		return 0, err
+	}
+	if int(l) > len(buf) {
+		return 0, ErrUDPPacketSize
+	}
+	return io.ReadFull(reader, buf[:l])
+}
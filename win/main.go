@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"image/color"
@@ -24,6 +25,7 @@ import (
 
 var (
 	config *core.Config
+	client *core.Client
 
 	App        fyne.App
 	MainWindow fyne.Window
@@ -120,12 +122,14 @@ func initMainWindow() {
 	MainWindow.SetContent(container.NewMax(infoView))
 
 	go showInputCode(func(code int) {
+		client = core.NewClient(config, code)
+
 		observer := make(chan *core.ClientStatus, 8)
-		core.AttachStatusObserver(observer)
+		client.AttachStatusObserver(observer)
 		go daemon(observer, infoView)
 
 		go func() {
-			if !startProxy(code) {
+			if !startProxy() {
 				return
 			}
 			addInfoLine(infoView, "\n\n创建虚拟网卡...")
@@ -220,9 +224,9 @@ func showErrorDlg(err error, onClosed func()) {
 	errdlg.Show()
 }
 
-func startProxy(code int) bool {
-	if err := core.Start(config, code); err != nil {
-		showErrorDlg(fmt.Errorf("core.Start %+v", err), func() {
+func startProxy() bool {
+	if err := client.Start(context.Background()); err != nil {
+		showErrorDlg(fmt.Errorf("client.Start %+v", err), func() {
 			App.Quit()
 		})
 		return false
@@ -257,6 +261,9 @@ func daemon(observer chan *core.ClientStatus, text *widget.RichText) {
 		if status.GetStat() != last {
 			last = status.GetStat()
 			addStatusText(status.GetStat(), text)
+			if last == core.ClientStatusStep_Failed && status.GetReason() != "" {
+				addInfoLine(text, "\n"+status.GetReason())
+			}
 		}
 	}
 }
@@ -290,10 +297,13 @@ func addStatusText(status core.ClientStatusStep, text *widget.RichText) {
 func showSuccessInfo(text *widget.RichText) {
 	addInfoLine(text, "\n\n完成\n\n")
 	n := fmt.Sprintf("延迟： %d\n本地socks5： %s\n虚拟网卡地址： %s\n自动拦截并转发请求网段： %s",
-		core.Status.GetPing(),
+		client.Status.GetPing(),
 		config.Listen,
 		config.TunIP,
 		config.TunRoute)
+	for _, item := range client.Status.GetMapTargets() {
+		n += fmt.Sprintf("\n端口映射 %s： %s -> %s", item.Name, item.Local, item.Target)
+	}
 	addInfoLine(text, n)
 }
 